@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// unsafePathChars matches the characters that are replaced in archive file names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// JSONLArchive writes scraped data to JSON Lines files without a database. The cards
+// of a set are written to <Dir>/<product line>/<set>.jsonl, one CardAttrs per line,
+// and the sets of a product line to <Dir>/<product line>/_sets.jsonl. Files written
+// by an earlier run are replaced. It is safe for concurrent use.
+type JSONLArchive struct {
+	Dir     string
+	mu      sync.Mutex
+	written map[string]bool // Files written by this run, which are appended to
+}
+
+// NewJSONLArchive returns a JSONLArchive writing to dir, which is created if needed.
+func NewJSONLArchive(dir string) (*JSONLArchive, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLArchive{Dir: dir, written: make(map[string]bool)}, nil
+}
+
+// WriteCards appends a batch of card listings to the file of their set.
+func (a *JSONLArchive) WriteCards(batch []CardAttrs) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	path := a.Path(batch[0].ProductLineURLName, batch[0].SetURLName)
+	lines := make([]interface{}, len(batch))
+	for i := range batch {
+		lines[i] = batch[i]
+	}
+	return a.write(path, lines)
+}
+
+// WriteSets writes the sets listed for a product line to its _sets.jsonl file.
+func (a *JSONLArchive) WriteSets(productLine string, sets []itemInfo) error {
+	lines := make([]interface{}, len(sets))
+	for i := range sets {
+		lines[i] = sets[i]
+	}
+	return a.write(a.Path(productLine, "_sets"), lines)
+}
+
+// Path returns the path of the file of a set, or of another file named name, of a
+// product line.
+func (a *JSONLArchive) Path(productLine, name string) string {
+	return filepath.Join(a.Dir, archiveName(productLine), archiveName(name)+".jsonl")
+}
+
+// archiveName returns name with the characters that are unsafe in file names replaced.
+func archiveName(name string) string {
+	name = unsafePathChars.ReplaceAllString(name, "-")
+	if name == "" || name == "." || name == ".." {
+		return "unknown"
+	}
+	return name
+}
+
+// write encodes lines as JSON Lines and adds them to the file at path. The file is
+// truncated the first time it is written by this run.
+func (a *JSONLArchive) write(path string, lines []interface{}) error {
+	var buff bytes.Buffer
+	encoder := json.NewEncoder(&buff)
+	for _, line := range lines {
+		err := encoder.Encode(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !a.written[path] {
+		flags |= os.O_TRUNC
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buff.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	a.written[path] = true
+	return nil
+}
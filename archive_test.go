@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TEST: JSONLArchive writes card listings to one JSON Lines file per set
+func TestJSONLArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listing := func(set string, productID float32) CardAttrs {
+		return CardAttrs{ProductLineURLName: "YuGiOh", SetName: set, SetURLName: set, ProductID: productID}
+	}
+	countLines := func(path string) int {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		lines := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var attrs CardAttrs
+			if err = json.Unmarshal(scanner.Bytes(), &attrs); err != nil {
+				t.Fatal(err)
+			}
+			lines++
+		}
+		return lines
+	}
+
+	run := func(batches ...[]CardAttrs) *JSONLArchive {
+		archive, err := NewJSONLArchive(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fanOut := NewFanOut()
+		fanOut.Add(archive, SinkOptions{Workers: 2})
+		var wg sync.WaitGroup
+		dataChan := make(chan []CardAttrs, len(batches)+2)
+		wg.Add(2)
+		go SinkCardAttrs(&wg, dataChan, fanOut)
+		go SinkCardAttrs(&wg, dataChan, fanOut)
+		for _, batch := range batches {
+			dataChan <- batch
+		}
+		dataChan <- nil
+		dataChan <- nil
+		wg.Wait()
+		if err := fanOut.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return archive
+	}
+	archive := run(
+		[]CardAttrs{listing("metal-raiders", 1), listing("metal-raiders", 2)},
+		[]CardAttrs{listing("metal-raiders", 3)},
+		[]CardAttrs{listing("spell/ruler", 4)},
+	)
+	path := filepath.Join(dir, "YuGiOh", "metal-raiders.jsonl")
+	if archive.Path("YuGiOh", "metal-raiders") != path || countLines(path) != 3 {
+		t.Fatal("Expected 3 listings in", path)
+	}
+	if countLines(filepath.Join(dir, "YuGiOh", "spell-ruler.jsonl")) != 1 {
+		t.Fatal("Expected the set url name to be made safe for a file name")
+	}
+
+	run([]CardAttrs{listing("metal-raiders", 5)})
+	if countLines(path) != 1 {
+		t.Fatal("Expected a new run to replace the file of a set")
+	}
+	if err = archive.WriteSets("YuGiOh", []itemInfo{{Value: "Metal Raiders", URLValue: "metal-raiders"}}); err != nil {
+		t.Fatal(err)
+	}
+	if countLines(archive.Path("YuGiOh", "_sets")) != 1 {
+		t.Fatal("Expected the set list of the product line")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"testing"
 
@@ -56,16 +55,80 @@ func TestMakeSetMap(t *testing.T) {
 	}
 }
 
+// TEST: writeProductMappings and LookupCardIDs
+func TestProductMappings(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	tx := writeProductMappings(db, []ProductMapping{{ProductID: 100, CardID: 1}, {ProductID: 200, CardID: 2}})
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	tx = writeProductMappings(db, []ProductMapping{{ProductID: 100, CardID: 3}}) // Mapped to another card
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	cardIDs, err := LookupCardIDs(db, []uint{100, 200, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cardIDs) != 2 || cardIDs[100] != 3 || cardIDs[200] != 2 {
+		t.Fatal("Expected map[100:3 200:2]  Got:", cardIDs)
+	}
+}
+
 // Clean up after testing
 func TestCleanUp(t *testing.T) {
-	var dataSource DataSourceName
-	dataSource.Init()
+	dataSource := GetDataSource()
 	db := GetDBConnection(dataSource.DSNString(), logger.Silent)
 	DropTables(db)
 }
 
 func TestMigrate(t *testing.T) {
 	ds := GetDataSource()
-	fmt.Println(ds.DSNString())
-	Migrate(ds.DSNString(), tcm.ProductLine{}, tcm.SetInfo{}, tcm.YuGiOhCardInfo{})
+	Migrate(ds.DSNString())
+}
+
+// TEST: WriteProductLineInfo and WriteSetInfo update the rows of an earlier scrape in place
+func TestRewriteProductLine(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	data := Result{TotalResults: 3, Aggregations: aggregation{
+		ProductLineName: []itemInfo{{Value: "YuGiOh", URLValue: "YuGiOh", IsActive: true}},
+		SetName:         []itemInfo{{Value: "Metal Raiders", URLValue: "metal-raiders", Count: 2}, {Value: "Spell Ruler", URLValue: "spell-ruler", Count: 1}},
+	}}
+	for run := 0; run < 2; run++ {
+		if tx := WriteProductLineInfo(db, data); tx.Error != nil {
+			t.Fatal(tx.Error)
+		}
+		if tx := WriteSetInfo(db, data.Aggregations); tx.Error != nil {
+			t.Fatal(tx.Error)
+		}
+		data.TotalResults = 4
+		data.Aggregations.SetName = append(data.Aggregations.SetName, itemInfo{Value: "Pharaoh's Servant", URLValue: "pharaohs-servant", Count: 1})
+		data.Aggregations.SetName[0].Count = 3
+	}
+
+	var productLines []tcm.ProductLine
+	db.Find(&productLines)
+	if len(productLines) != 1 || productLines[0].CardCount != 4 || productLines[0].SetCount != 3 {
+		t.Fatal("Expected one updated product line  Got:", productLines)
+	}
+	var sets []tcm.SetInfo
+	db.Order("id").Find(&sets)
+	if len(sets) != 3 || sets[0].CardCount != 3 || sets[2].URLName != "pharaohs-servant" {
+		t.Fatal("Expected the sets to be updated and the new set added  Got:", sets)
+	}
+
+	// TEST: Product lines are looked up ignoring case
+	productLineID, err := GetProductLineID(db, "yugioh")
+	if err != nil || productLineID != productLines[0].ID {
+		t.Fatal("Expected the product line  Got:", productLineID, err)
+	}
+	setMap, err := MakeSetMap(db, "YUGIOH")
+	if err != nil || len(setMap) != 3 {
+		t.Fatal("Expected the sets of the product line  Got:", setMap, err)
+	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errBlobNotFound is returned by BlobStore.Get for locations that hold no blob.
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the downloaded image files.
+type BlobStore interface {
+	// Put stores data under key and returns the location of the stored blob.
+	// Depending on the store the location may differ from the key.
+	Put(key string, data []byte) (string, error)
+
+	// Get returns the blob stored at location, or errBlobNotFound.
+	Get(location string) ([]byte, error)
+
+	// Size returns the size of the blob stored at location, or errBlobNotFound,
+	// without reading the blob.
+	Size(location string) (int64, error)
+
+	// List returns the locations of all blobs in the store.
+	List() ([]string, error)
+}
+
+// OpenBlobStore returns the BlobStore described by spec, which is one of
+//
+//	<directory> or dir://<directory>    plain directory, blobs are stored under their key
+//	cas://<directory>                   content-addressed directory, see CASStore
+//	s3://<bucket>[/<prefix>][?options]  S3-compatible object store, see NewS3Store
+func OpenBlobStore(spec string) (BlobStore, error) {
+	i := strings.Index(spec, "://")
+	if i == -1 {
+		return NewDirStore(spec)
+	}
+	switch spec[:i] {
+	case "dir":
+		return NewDirStore(spec[i+3:])
+	case "cas":
+		return NewCASStore(spec[i+3:])
+	case "s3":
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Store(u)
+	default:
+		return nil, fmt.Errorf("unsupported image store %q", spec)
+	}
+}
+
+/*****************************************************************************************/
+
+// DirStore stores blobs as files in a directory. The location of a blob is its key.
+type DirStore struct {
+	Dir string
+}
+
+// NewDirStore returns a DirStore for dir, creating the directory if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if dir == "" {
+		return nil, errors.New("no image directory given")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStore{Dir: dir}, nil
+}
+
+// Put writes data to the file named key, see writeFileAtomic.
+func (ds *DirStore) Put(key string, data []byte) (string, error) {
+	name := filepath.Join(ds.Dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return "", err
+	}
+	return key, writeFileAtomic(name, data)
+}
+
+// Get reads the file at location.
+func (ds *DirStore) Get(location string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ds.Dir, filepath.FromSlash(location)))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+// Size returns the size of the file at location.
+func (ds *DirStore) Size(location string) (int64, error) {
+	info, err := os.Stat(filepath.Join(ds.Dir, filepath.FromSlash(location)))
+	if os.IsNotExist(err) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// List returns the paths of all files below the directory, ignoring the temporary
+// files of unfinished writes.
+func (ds *DirStore) List() ([]string, error) {
+	var locations []string
+	err := filepath.Walk(ds.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(ds.Dir, name)
+		if err != nil {
+			return err
+		}
+		locations = append(locations, filepath.ToSlash(rel))
+		return nil
+	})
+	return locations, err
+}
+
+/*****************************************************************************************/
+
+// CASStore is a content-addressed directory. Blobs are stored under the SHA-256 digest
+// of their content, so identical art shared by reprints of a card is stored only once.
+// The location of a blob is objects/<first two digest digits>/<digest><key extension>.
+type CASStore struct {
+	dir DirStore
+}
+
+// NewCASStore returns a CASStore for dir, creating the directory if needed.
+func NewCASStore(dir string) (*CASStore, error) {
+	ds, err := NewDirStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CASStore{dir: *ds}, nil
+}
+
+// Put stores data unless a blob with the same content already exists.
+func (cs *CASStore) Put(key string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	location := path.Join("objects", digest[:2], digest+path.Ext(key))
+	_, err := os.Stat(filepath.Join(cs.dir.Dir, filepath.FromSlash(location)))
+	if err == nil {
+		return location, nil
+	}
+	return cs.dir.Put(location, data)
+}
+
+// Get reads the blob at location.
+func (cs *CASStore) Get(location string) ([]byte, error) {
+	return cs.dir.Get(location)
+}
+
+// Size returns the size of the blob at location.
+func (cs *CASStore) Size(location string) (int64, error) {
+	return cs.dir.Size(location)
+}
+
+// List returns the locations of all stored blobs.
+func (cs *CASStore) List() ([]string, error) {
+	locations, err := cs.dir.List()
+	if err != nil {
+		return nil, err
+	}
+	objects := locations[:0]
+	for _, location := range locations {
+		if strings.HasPrefix(location, "objects/") {
+			objects = append(objects, location)
+		}
+	}
+	return objects, nil
+}
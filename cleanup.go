@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// OwnedModels lists the models whose tables are created and managed by the scraper.
+// Cleanup functions never touch tables that are not listed here.
+var OwnedModels = []interface{}{
+	&tcm.ProductLine{},
+	&tcm.SetInfo{},
+	&tcm.YuGiOhCardInfo{},
+	&ProductMapping{},
+	&ImageRecord{},
+	&CardPrice{},
+	&KnownSet{},
+	&SchemaVersion{},
+}
+
+// OwnedTables returns the names of the scraper's tables that exist in the database.
+func OwnedTables(db *gorm.DB) ([]string, error) {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := dialect.TableNames(db)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, name := range existing {
+		present[name] = true
+	}
+
+	var names []string
+	for _, model := range OwnedModels {
+		stmt := &gorm.Statement{DB: db}
+		err = stmt.Parse(model)
+		if err != nil {
+			return nil, err
+		}
+		if present[stmt.Schema.Table] {
+			names = append(names, stmt.Schema.Table)
+		}
+	}
+	return names, nil
+}
+
+// CleanProductLine deletes the product line identified by name, or by url name,
+// together with its sets, cards, prices, product mappings and image manifest
+// records. Data of other product lines is left untouched. Deleting a product line
+// that does not exist is not an error.
+func CleanProductLine(db *gorm.DB, name string) error {
+	var productLines []tcm.ProductLine
+	tx := whereProductLine(db, name).Find(&productLines)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, productLine := range productLines {
+			err := deleteProductLine(tx, productLine.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CleanProductLineID deletes the product line with the given id like CleanProductLine,
+// leaving other product lines of the same name alone.
+func CleanProductLineID(db *gorm.DB, productLineID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return deleteProductLine(tx, productLineID)
+	})
+}
+
+// deleteProductLine deletes the product line with the given id and the rows that
+// belong to it.
+func deleteProductLine(tx *gorm.DB, productLineID uint) error {
+	err := imageRecordsOf(tx, productLineID).Delete(&ImageRecord{}).Error
+	if err != nil {
+		return err
+	}
+	cardIDs := tx.Model(&ProductMapping{}).Select("card_id").Where("product_line_id = ?", productLineID)
+	err = tx.Where("card_id IN (?)", cardIDs).Delete(&CardPrice{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("product_line_id = ?", productLineID).Delete(&ProductMapping{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("product_line_id = ?", productLineID).Delete(&tcm.YuGiOhCardInfo{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("product_line_id = ?", productLineID).Delete(&tcm.SetInfo{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(&tcm.ProductLine{}, productLineID).Error
+}
+
+// Confirm writes prompt to out and reads the answer from in. Only an answer of
+// "y" or "yes" is treated as a confirmation.
+func Confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB returns a connection to a migrated SQLite database in a temporary directory.
+// The returned function removes the directory.
+func testDB(t *testing.T) (*gorm.DB, func()) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := DataSourceName{Driver: "sqlite", Database: filepath.Join(dir, "tcg.db")}
+	db := GetDBConnection(ds.DSNString(), logger.Silent)
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() { os.RemoveAll(dir) }
+}
+
+// TEST: CleanProductLine and DropTables leave foreign data alone
+func TestCleanProductLine(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	for _, name := range []string{"YuGiOh", "Magic"} {
+		productLine := tcm.ProductLine{Name: name, URLName: name}
+		db.Create(&productLine)
+		set := tcm.SetInfo{Name: name + " Set", ProductLineID: productLine.ID}
+		db.Create(&set)
+		db.Create(&tcm.YuGiOhCardInfo{Name: name + " Card", SetID: set.ID, ProductLineID: productLine.ID})
+	}
+	if err := db.Exec("CREATE TABLE unrelated (id INTEGER)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err := CleanProductLine(db, "yugioh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var productLines, cards int64
+	db.Model(&tcm.ProductLine{}).Count(&productLines)
+	db.Model(&tcm.YuGiOhCardInfo{}).Where("product_line_id IN (?)", db.Model(&tcm.ProductLine{}).Select("id")).Count(&cards)
+	if productLines != 1 || cards != 1 {
+		t.Fatal("Expected remaining product lines: 1 cards: 1  Got:", productLines, cards)
+	}
+
+	// TEST: CleanProductLineID deletes only the product line with that id
+	duplicate := tcm.ProductLine{Name: "Magic", URLName: "Magic"}
+	db.Create(&duplicate)
+	db.Create(&tcm.SetInfo{Name: "Magic Set", ProductLineID: duplicate.ID})
+	if err = CleanProductLineID(db, duplicate.ID); err != nil {
+		t.Fatal(err)
+	}
+	var sets int64
+	db.Model(&tcm.ProductLine{}).Count(&productLines)
+	db.Model(&tcm.SetInfo{}).Count(&sets)
+	if productLines != 1 || sets != 1 {
+		t.Fatal("Expected remaining product lines: 1 sets: 1  Got:", productLines, sets)
+	}
+
+	DropTables(db)
+	if !db.Migrator().HasTable("unrelated") {
+		t.Fatal("DropTables dropped a table not owned by the scraper")
+	}
+	if db.Migrator().HasTable(&tcm.SetInfo{}) {
+		t.Fatal("DropTables did not drop the set info table")
+	}
+}
+
+// TEST: Confirm
+func TestConfirm(t *testing.T) {
+	answers := map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false}
+	for answer, expected := range answers {
+		var out strings.Builder
+		if Confirm(strings.NewReader(answer), &out, "Drop?") != expected {
+			t.Fatalf("Expected %v for answer %q", expected, answer)
+		}
+	}
+}
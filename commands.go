@@ -0,0 +1,784 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// scrapeCommand implements "scraper scrape [flags] [product line ...]". It scrapes the
+// sets, cards and card images of every named or configured product line. With -dry-run
+// the scraped data is compared with the database instead, see DryRunReport, and with
+// -output-dir it is written to files, see scrapeToFiles. Card listings are also written
+// to the sinks in config.Sinks, see FanOut, and the webhooks in config.Notify are
+// notified when the scrape finishes or fails, see Run.
+func scrapeCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	setFilter := setFilterFlags(flags)
+	keepOnError := flags.Bool("keep-on-error", false, "keep the data written for a product line when scraping it fails")
+	noImages := flags.Bool("no-images", false, "do not download card images")
+	dryRun := flags.Bool("dry-run", false, "fetch and compare the data without writing it; print per set counts of new, changed and unchanged cards and images")
+	outputDir := flags.String("output-dir", "", "write the card listings to JSON Lines files in this directory instead of the database; no database is needed and no images are downloaded")
+	flags.StringVar(&config.Sinks.Archive.Target, "archive-dir", config.Sinks.Archive.Target, "also write the card listings to JSON Lines files in this directory")
+	flags.StringVar(&config.Sinks.Webhook.Target, "webhook-sink", config.Sinks.Webhook.Target, "also post every batch of card listings as JSON to this URL")
+	workerFlags(flags)
+	initBatches := batchFlags(flags)
+	imageFlags(flags)
+	flags.Parse(args)
+	applyConfig(*outputDir == "")
+	names := productLines(flags.Args())
+	if len(names) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	workers := config.Workers
+	if *outputDir != "" {
+		if *dryRun {
+			log.Fatal("scrape: -dry-run and -output-dir exclude each other")
+		}
+		scrapeToFiles(names, *outputDir, setFilter(), StartRun("scrape", names, config.Notify))
+		return
+	}
+	var run *Run
+	if !*dryRun {
+		run = StartRun("scrape", names, config.Notify)
+	}
+
+	dbConn := openDatabase(true)
+	metrics := initBatches(dbConn)
+	var imageStore BlobStore
+	var err error
+	if !*noImages {
+		imageStore, err = OpenBlobStore(config.Images.Store)
+		if err != nil {
+			fatal(err) // Notifies run of the failed scrape, unlike log.Fatal
+		}
+	}
+	err = DatabaseConnConfig(dbConn, 10, 10)
+	if err != nil {
+		fatal(err)
+	}
+	var report *DryRunReport
+	if *dryRun {
+		report = NewDryRunReport(imageStore)
+	}
+
+	for _, productLineName := range names {
+		var createdID uint // The id of the product line if this run created it
+		abort := func(err error) {
+			if *dryRun {
+				log.Fatal(err) // Nothing was written
+			}
+			abortProductLine(dbConn, productLineName, createdID, *keepOnError, err)
+		}
+		response := fetchProductLine(productLineName)
+		if !*dryRun {
+			_, err := GetProductLineID(dbConn, productLineName)
+			existed := err == nil
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				abort(err)
+			}
+			tx := WriteProductLineInfo(dbConn, response.Results[0])
+			if tx.Error != nil {
+				abort(tx.Error)
+			}
+			if !existed {
+				createdID, err = GetProductLineID(dbConn, productLineName)
+				if err != nil {
+					abort(err)
+				}
+			}
+			fmt.Println("Product line info written to database.")
+
+			tx = WriteSetInfo(dbConn, response.Results[0].Aggregations)
+			if tx.Error != nil {
+				abort(tx.Error)
+			}
+			fmt.Println("Set info written to database.")
+		}
+
+		var wg sync.WaitGroup
+		var fanOut *FanOut
+		requestChan := make(chan *RequestPayload, workers*2) // Buffered channel used to pass RequestPayloads
+		{
+			cardAttrChan := make(chan []CardAttrs, workers*2) // Buffered channel used to pass lists of CardAttrs
+			setmap, err := MakeSetMap(dbConn, productLineName)
+			if err != nil {
+				abort(err)
+			}
+
+			// Create data request and data write threads
+			wg.Add(workers)
+			for i := 0; i < workers; i++ {
+				go MakeDataRequest(requestChan, cardAttrChan)
+			}
+			if !*dryRun {
+				fanOut = NewFanOut()
+				fanOut.Add(NewDatabaseSink(dbConn, setmap), SinkOptions{Workers: workers, Buffer: workers * 2})
+				err = addConfiguredSinks(fanOut, config.Sinks)
+				if err != nil {
+					abort(err)
+				}
+			}
+			for i := 0; i < workers; i++ {
+				if *dryRun {
+					go ReportCardInfo(&wg, cardAttrChan, dbConn, setmap, report)
+				} else {
+					go SinkCardAttrs(&wg, cardAttrChan, fanOut)
+				}
+			}
+		}
+		requestSets(requestChan, productLineName, response, filterSets(dbConn, productLineName, response, setFilter(), run))
+		TerminateCardInfoGoroutines(&wg, requestChan, workers) // Send MakeDataRequest goroutines termination value and wait for them to complete
+		if fanOut != nil {
+			err := closeFanOut(fanOut, run)
+			if err != nil {
+				abort(err)
+			}
+		}
+
+		if *noImages || *dryRun {
+			continue
+		}
+		productLineID, err := GetProductLineID(dbConn, productLineName)
+		if err != nil {
+			abort(err)
+		}
+		imageFailures, err := FetchImages(dbConn, imageStore, ImageSelection{ProductLineID: productLineID}.Query(dbConn), workers, os.Stdout)
+		if err != nil {
+			abort(err)
+		}
+		imageFailures.Report(os.Stdout)
+		run.Count("image_failures", int64(len(imageFailures.Failures())))
+	}
+	if *dryRun {
+		report.Print(os.Stdout)
+		return
+	}
+	metrics.Report(os.Stdout)
+	run.Finish(nil)
+}
+
+// closeFanOut waits for the sinks of fanOut, reports them if there are several and adds
+// the cards written to the first sink and the errors of the others to run.
+func closeFanOut(fanOut *FanOut, run *Run) error {
+	err := fanOut.Close()
+	stats := fanOut.Stats()
+	if len(stats) > 1 {
+		fanOut.Report(os.Stdout)
+	}
+	for i, elem := range stats {
+		if i == 0 {
+			run.Count("cards", elem.Cards)
+		} else if elem.Err != nil {
+			run.AddError(fmt.Errorf("sink %s: %v", elem.Name, elem.Err))
+		}
+	}
+	return err
+}
+
+// scrapeToFiles scrapes the card listings of the named product lines into a
+// JSONLArchive in dir, and the sinks in config.Sinks, without a database. Sets cannot
+// be filtered by the time they were first seen, since that is recorded in the database.
+func scrapeToFiles(names []string, dir string, filter *SetFilter, run *Run) {
+	if !filter.AddedSince.IsZero() {
+		log.Fatal("scrape: -added-since needs the database and cannot be used with -output-dir")
+	}
+	archive, err := NewJSONLArchive(dir)
+	if err != nil {
+		fatal(err)
+	}
+	workers := config.Workers
+	for _, productLineName := range names {
+		response := fetchProductLine(productLineName)
+		sets := response.Results[0].Aggregations.SetName
+		err = archive.WriteSets(productLineURLName(response, productLineName), sets)
+		if err != nil {
+			fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		requestChan := make(chan *RequestPayload, workers*2)
+		cardAttrChan := make(chan []CardAttrs, workers*2)
+		fanOut := NewFanOut()
+		fanOut.Add(archive, SinkOptions{Workers: workers, Buffer: workers * 2})
+		err = addConfiguredSinks(fanOut, config.Sinks)
+		if err != nil {
+			fatal(err)
+		}
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go MakeDataRequest(requestChan, cardAttrChan)
+		}
+		for i := 0; i < workers; i++ {
+			go SinkCardAttrs(&wg, cardAttrChan, fanOut)
+		}
+		selected := filter.Select(sets, nil)
+		fmt.Printf("Selected %d of %d sets.\n", len(selected), len(sets))
+		run.Count("sets", int64(len(selected)))
+		requestSets(requestChan, productLineName, response, selected)
+		TerminateCardInfoGoroutines(&wg, requestChan, workers)
+		err = closeFanOut(fanOut, run)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	fmt.Println("Card listings written to", dir)
+	run.Finish(nil)
+}
+
+// productLineURLName returns the url name of the active product line of response, or
+// name if there is none.
+func productLineURLName(response *ResponsePayload, name string) string {
+	for _, elem := range response.Results[0].Aggregations.ProductLineName {
+		if elem.IsActive {
+			return elem.URLValue
+		}
+	}
+	return name
+}
+
+// setsCommand implements "scraper sets [flags] <product line>". It lists the sets
+// tcgplayer offers for a product line, or the sets stored in the database.
+func setsCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	stored := flags.Bool("stored", false, "list the sets stored in the database instead of asking tcgplayer")
+	flags.IntVar(&config.HTTP.Timeout, "timeout", config.HTTP.Timeout, "HTTP request timeout in seconds")
+	parseFlags(flags, args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var sets []itemInfo
+	if *stored {
+		db := openDatabase(true)
+		var setInfos []tcm.SetInfo
+		tx := db.Where("product_line_id = ?", productLineArg(db, flags.Args())).Order("name").Find(&setInfos)
+		if tx.Error != nil {
+			log.Fatal(tx.Error)
+		}
+		for _, elem := range setInfos {
+			sets = append(sets, itemInfo{Value: elem.Name, URLValue: elem.URLName, Count: float32(elem.CardCount)})
+		}
+	} else {
+		sets = fetchProductLine(flags.Arg(0)).Results[0].Aggregations.SetName
+	}
+	fmt.Printf("%-60s %-60s %s\n", "NAME", "URL NAME", "CARDS")
+	for _, elem := range sets {
+		fmt.Printf("%-60s %-60s %d\n", elem.Value, elem.URLValue, int(elem.Count))
+	}
+}
+
+// imagesCommand implements "scraper images [flags] [product line]". It downloads the
+// images of cards already in the database without scraping card data.
+func imagesCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "only fetch the images of the named set")
+	cardList := flags.String("cards", "", "only fetch the images of these comma separated card ids")
+	missingOnly := flags.Bool("missing", false, "only fetch images that are not in the image manifest, e.g. after failures")
+	workerFlags(flags)
+	imageFlags(flags)
+	parseFlags(flags, args)
+
+	db := openDatabase(true)
+	var sel ImageSelection
+	var err error
+	sel.ProductLineID = productLineArg(db, flags.Args())
+	if *setName != "" {
+		sel.SetID, err = GetSetID(db, sel.ProductLineID, *setName)
+		if err != nil {
+			log.Fatal("Unknown set ", *setName, ": ", err)
+		}
+	}
+	if *cardList != "" {
+		sel.CardIDs, err = parseIDList(*cardList)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *missingOnly {
+		sel.MissingOnly = true
+		SkipExistingImages = true // Cards are selected by their missing variants, keep the others
+	}
+
+	store, err := OpenBlobStore(config.Images.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failures, err := FetchImages(db, store, sel.Query(db), config.Workers, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failures.Report(os.Stdout)
+	if len(failures.Failures()) > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyCommand implements "scraper verify [product line]". It reports differences
+// between the image manifest and the blobs in the image store.
+func verifyCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	imageStoreFlag(flags)
+	parseFlags(flags, args)
+
+	db := openDatabase(true)
+	store, err := OpenBlobStore(config.Images.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	problems, err := VerifyImages(db, store, productLineArg(db, flags.Args()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	PrintImageProblems(os.Stdout, problems)
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// missingCommand implements "scraper missing [flags] [product line]". It lists the card
+// image variants selected with -image-variants that are not in the image manifest.
+func missingCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	flags.Var((*listFlag)(&config.Images.Variants), "image-variants", "comma separated list of image sizes to look for, e.g. 200w,400w,original")
+	parseFlags(flags, args)
+
+	db := openDatabase(true)
+	missing, err := MissingImages(db, productLineArg(db, flags.Args()), ImageVariants)
+	if err != nil {
+		log.Fatal(err)
+	}
+	PrintMissingImages(os.Stdout, missing)
+	if len(missing) > 0 {
+		os.Exit(1)
+	}
+}
+
+// pricesCommand implements "scraper prices [flags] [product line ...]". It records the
+// current prices of the cards of every named or configured product line, see CardPrice.
+// The cards must have been scraped before. The webhooks in config.Notify are notified
+// of the largest price moves, see PriceChanges.
+func pricesCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	setFilter := setFilterFlags(flags)
+	workerFlags(flags)
+	initBatches := batchFlags(flags)
+	parseFlags(flags, args)
+	names := productLines(flags.Args())
+	if len(names) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	workers := config.Workers
+
+	run := StartRun("prices", names, config.Notify)
+	dbConn := openDatabase(true)
+	metrics := initBatches(dbConn)
+	for _, productLineName := range names {
+		response := fetchProductLine(productLineName)
+
+		var wg sync.WaitGroup
+		var unmapped int64
+		requestChan := make(chan *RequestPayload, workers*2) // Buffered channel used to pass RequestPayloads
+		cardAttrChan := make(chan []CardAttrs, workers*2)    // Buffered channel used to pass lists of CardAttrs
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go MakeDataRequest(requestChan, cardAttrChan)
+		}
+		for i := 0; i < workers; i++ {
+			go WriteCardPrices(&wg, cardAttrChan, dbConn, &unmapped)
+		}
+		requestSets(requestChan, productLineName, response, filterSets(dbConn, productLineName, response, setFilter(), run))
+		TerminateCardInfoGoroutines(&wg, requestChan, workers)
+		run.Count("unmapped", unmapped)
+		if unmapped > 0 {
+			fmt.Printf("Skipped %d products without a card, run \"scraper scrape %s\" first.\n", unmapped, productLineName)
+		}
+	}
+	metrics.Report(os.Stdout)
+	if run.Notifies() {
+		var prices int64
+		tx := dbConn.Model(&CardPrice{}).Where("fetched_at >= ?", run.StartedAt()).Count(&prices)
+		if tx.Error != nil {
+			run.AddError(tx.Error)
+		}
+		run.Count("prices", prices)
+		changes, err := PriceChanges(dbConn, run.StartedAt(), config.Notify.PriceChange, config.Notify.TopPriceChanges)
+		if err != nil {
+			run.AddError(err)
+		}
+		run.SetPriceChanges(changes)
+	}
+	run.Finish(nil)
+}
+
+// exportCommand implements "scraper export [flags] [product line]". It writes the
+// scraped data to CSV or JSON Lines files, one file per entity or one denormalized
+// catalog file, or to a SQLite database file, see ExportSQLite.
+func exportCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	output := flags.String("output", "", "write to this file instead of stdout; a directory if several entities are exported")
+	format := flags.String("format", "csv", "file format: "+strings.Join(ExportFormats, ", ")+" or sqlite")
+	fullText := flags.Bool("fts", true, "add a full-text index on card names and descriptions to sqlite exports; skipped with a warning unless set explicitly if SQLite has no FTS5 support")
+	entities := flags.String("entities", "cards", "comma separated entities to export: "+strings.Join(ExportEntities, ", ")+" or all")
+	denormalized := flags.Bool("denormalized", false, "export one "+CatalogEntity+" file with a row per card and its set, product line, latest price and images")
+	setFilter := setFilterFlags(flags)
+	flags.Var((*listFlag)(&config.Images.Variants), "image-variants", "comma separated image variants whose paths are added to the catalog")
+	parseFlags(flags, args)
+
+	selected := splitList(*entities)
+	if *entities == "all" {
+		selected = ExportEntities
+	}
+	if *denormalized {
+		selected = []string{CatalogEntity}
+	}
+	if len(selected) > 1 && *output == "" && *format != "sqlite" {
+		log.Fatal("export: -output must name a directory when several entities are exported")
+	}
+
+	db := openDatabase(true)
+	productLineID := productLineArg(db, flags.Args())
+	setIDs, err := ExportSetIDs(db, productLineID, setFilter())
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter := ExportFilter{ProductLineID: productLineID, SetIDs: setIDs}
+	if *format == "sqlite" {
+		if *output == "" {
+			log.Fatal("export: -output must name the SQLite file")
+		}
+		counts, err := ExportSQLite(db, *output, filter, *fullText)
+		if err == errNoFTS5 && !flagSet(flags, "fts") {
+			log.Println("Warning:", err, "- exporting without the full-text index")
+			counts, err = ExportSQLite(db, *output, filter, false)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Exported %d product lines, %d sets, %d cards and %d prices to %s\n",
+			counts["product_lines"], counts["sets"], counts["cards"], counts["prices"], *output)
+		return
+	}
+	if len(selected) == 1 {
+		exportEntity(db, *output, *format, selected[0], filter)
+		return
+	}
+	err = os.MkdirAll(*output, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entity := range selected {
+		exportEntity(db, filepath.Join(*output, entity+"."+*format), *format, entity, filter)
+	}
+}
+
+// exportEntity exports entity to the file at path, or to stdout if path is empty.
+func exportEntity(db *gorm.DB, path, format, entity string, filter ExportFilter) {
+	out := os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	count, err := Export(db, out, format, entity, filter)
+	if err != nil {
+		log.Fatalf("export %s: %v", entity, err)
+	}
+	if path != "" {
+		fmt.Printf("Exported %d %s to %s\n", count, strings.Replace(entity, "_", " ", -1), path)
+	}
+}
+
+// migrateCommand implements "scraper migrate up [version] | down [steps] | status".
+func migrateCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	parseFlags(flags, args)
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db := openDatabase(false)
+	switch args[0] {
+	case "up":
+		var target uint64
+		if len(args) > 1 {
+			var err error
+			target, err = strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				log.Fatal("migrate up: invalid version: ", args[1])
+			}
+		}
+		applied, err := MigrateUp(db, uint(target))
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal("migrate down: invalid number of steps: ", args[1])
+			}
+		}
+		reverted, err := MigrateDown(db, steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted migration %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		states, err := MigrationStatus(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		PrintMigrationStatus(os.Stdout, states)
+	default:
+		log.Fatal("migrate: unknown action ", args[0])
+	}
+}
+
+// cleanCommand implements "scraper clean [flags] [product line ...]". Without arguments
+// all tables owned by the scraper are dropped, otherwise only the data of the named
+// product lines is deleted. Unless -yes is set the user is asked for confirmation.
+func cleanCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	assumeYes := flags.Bool("yes", false, "do not ask for confirmation before deleting data")
+	parseFlags(flags, args)
+	args = flags.Args()
+
+	db := openDatabase(false)
+	var prompt string
+	if len(args) == 0 {
+		names, err := OwnedTables(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(names) == 0 {
+			fmt.Println("Nothing to clean.")
+			return
+		}
+		prompt = fmt.Sprintf("Drop tables %s from database %s?", strings.Join(names, ", "), db.Migrator().CurrentDatabase())
+	} else {
+		prompt = fmt.Sprintf("Delete all data of product line(s) %s?", strings.Join(args, ", "))
+	}
+	if !*assumeYes && !Confirm(os.Stdin, os.Stdout, prompt) {
+		fmt.Println("Aborted.")
+		return
+	}
+
+	if len(args) == 0 {
+		DropTables(db)
+		return
+	}
+	for _, name := range args {
+		err := CleanProductLine(db, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Deleted product line", name)
+	}
+}
+
+// configCommand implements "scraper config show". It prints the configuration read
+// from the config file and the environment, with secrets redacted.
+func configCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	flags.Parse(args)
+	if flags.NArg() != 1 || flags.Arg(0) != "show" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	err := config.Show(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// statusCommand implements "scraper status".
+func statusCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	parseFlags(flags, args)
+
+	status, err := GetStatus(openDatabase(false))
+	if err != nil {
+		log.Fatal(err)
+	}
+	PrintStatus(os.Stdout, status)
+}
+
+// serveCommand implements "scraper serve [flags]", see NewServer.
+func serveCommand(cmd *Command, args []string) {
+	flags := newFlagSet(cmd)
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	timeout := flags.Int("timeout", 30, "read and write timeout of a request in seconds")
+	imageStoreFlag(flags)
+	parseFlags(flags, args)
+
+	db := openDatabase(true)
+	store, err := OpenBlobStore(config.Images.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := http.Server{
+		Addr:         *addr,
+		Handler:      NewServer(db, store),
+		ReadTimeout:  time.Duration(*timeout) * time.Second,
+		WriteTimeout: time.Duration(*timeout) * time.Second,
+	}
+	log.Println("Listening on", *addr)
+	log.Fatal(server.ListenAndServe())
+}
+
+/*****************************************************************************************/
+
+// fetchProductLine requests the product line and set aggregations of a product line,
+// retrying until tcgplayer answers.
+func fetchProductLine(productLineName string) *ResponsePayload {
+	requestInfo := GetRequestPayload(productLineName, "", "", 0)
+	for {
+		response, tcgpErr := MakeTcgPlayerRequest(requestInfo.ToJSON(), DefaultTimeout)
+		if tcgpErr == nil {
+			return response
+		}
+	}
+}
+
+// filterSets returns the sets of the product line response that pass filter. Unless run
+// is nil, e.g. for a dry run, sets that are not known yet are recorded as first seen now,
+// see KnownSet, and added to run as new sets if other sets of the product line were
+// known before.
+func filterSets(db *gorm.DB, productLineName string, response *ResponsePayload, filter *SetFilter, run *Run) []itemInfo {
+	sets := response.Results[0].Aggregations.SetName
+	firstSeen, err := FirstSeenSets(db, productLineName)
+	if err != nil {
+		fatal(err)
+	}
+	if run != nil {
+		var newSets []itemInfo
+		for _, set := range sets {
+			if _, ok := firstSeen[set.URLValue]; !ok {
+				newSets = append(newSets, set)
+			}
+		}
+		err = RecordKnownSets(db, productLineName, newSets, time.Now())
+		if err != nil {
+			fatal(err)
+		}
+		if len(firstSeen) > 0 {
+			run.AddNewSets(productLineName, newSets)
+		}
+	}
+	selected := filter.Select(sets, firstSeen)
+	fmt.Printf("Selected %d of %d sets.\n", len(selected), len(sets))
+	if run != nil {
+		run.Count("sets", int64(len(selected)))
+	}
+	return selected
+}
+
+// requestSets sends a RequestPayload for every one of sets, which belong to the product
+// line response, to requestChan.
+func requestSets(requestChan chan *RequestPayload, productLineName string, response *ResponsePayload, sets []itemInfo) {
+	aggregations := response.Results[0].Aggregations
+	for _, set := range sets {
+		requestChan <- GetRequestPayload(
+			productLineName,
+			aggregations.ProductTypeName[0].URLValue,
+			set.URLValue,
+			int(set.Count),
+		)
+	}
+}
+
+// selectSets returns the sets named in the comma separated setList, by name or url name
+// and ignoring case. All sets are returned if setList is empty.
+func selectSets(sets []itemInfo, setList string) []itemInfo {
+	if strings.TrimSpace(setList) == "" {
+		return sets
+	}
+	names := make(map[string]bool)
+	for _, elem := range strings.Split(setList, ",") {
+		names[strings.ToLower(strings.TrimSpace(elem))] = true
+	}
+	var selected []itemInfo
+	for _, set := range sets {
+		if names[strings.ToLower(set.Value)] || names[strings.ToLower(set.URLValue)] {
+			selected = append(selected, set)
+		}
+	}
+	return selected
+}
+
+// parseIDList parses a comma separated list of ids.
+func parseIDList(list string) ([]uint, error) {
+	var ids []uint
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(elem, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", elem)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// productLineArg returns the id of the product line named by the first argument, or
+// zero if no argument is given.
+func productLineArg(db *gorm.DB, args []string) uint {
+	if len(args) == 0 {
+		return 0
+	}
+	productLineID, err := GetProductLineID(db, args[0])
+	if err != nil {
+		log.Fatal("Unknown product line ", args[0], ": ", err)
+	}
+	return productLineID
+}
+
+// abortProductLine deletes the product line with the given id, which the aborted run
+// created, unless keep is set, and exits with err. A product line stored before the run
+// has an id of zero and is kept, so an earlier scrape is not lost.
+func abortProductLine(db *gorm.DB, productLine string, productLineID uint, keep bool, err error) {
+	if !keep && productLineID == 0 {
+		log.Println("Kept the data of product line", productLine, "which this run did not create")
+	} else if !keep {
+		cleanErr := CleanProductLineID(db, productLineID)
+		if cleanErr != nil {
+			log.Println("Cleanup of product line", productLine, "failed:", cleanErr)
+		} else {
+			log.Println("Deleted the partially written data of product line", productLine)
+		}
+	}
+	fatal(err)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TEST: selectSets matches set names and url names ignoring case
+func TestSelectSets(t *testing.T) {
+	sets := []itemInfo{
+		{Value: "Legend of Blue Eyes White Dragon", URLValue: "legend-of-blue-eyes-white-dragon"},
+		{Value: "Metal Raiders", URLValue: "metal-raiders"},
+		{Value: "Spell Ruler", URLValue: "spell-ruler"},
+	}
+	if len(selectSets(sets, "")) != 3 {
+		t.Fatal("Expected all sets for an empty list")
+	}
+	selected := selectSets(sets, "metal raiders, SPELL-RULER")
+	if len(selected) != 2 || selected[0].Value != "Metal Raiders" || selected[1].Value != "Spell Ruler" {
+		t.Fatal("Expected Metal Raiders and Spell Ruler  Got:", selected)
+	}
+	ids, err := parseIDList("3, 5,")
+	if err != nil || len(ids) != 2 || ids[1] != 5 {
+		t.Fatal("Expected ids [3 5]  Got:", ids, err)
+	}
+	if _, err = parseIDList("3,x"); err == nil {
+		t.Fatal("Expected an error for an invalid id")
+	}
+}
+
+// TEST: SetFilter selects sets by pattern, card count and the time they were first seen
+func TestSetFilter(t *testing.T) {
+	sets := []itemInfo{
+		{Value: "Legend of Blue Eyes White Dragon", URLValue: "legend-of-blue-eyes-white-dragon", Count: 126},
+		{Value: "Metal Raiders", URLValue: "metal-raiders", Count: 144},
+		{Value: "Duelist League Promo", URLValue: "duelist-league-promo", Count: 20},
+		{Value: "Spell Ruler", URLValue: "spell-ruler", Count: 104},
+	}
+	names := func(selected []itemInfo) string {
+		var list []string
+		for _, set := range selected {
+			list = append(list, set.URLValue)
+		}
+		return strings.Join(list, ",")
+	}
+	pattern := func(p string) SetPattern {
+		parsed, err := ParseSetPattern(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	filter := SetFilter{Include: []SetPattern{pattern("*RAIDERS"), pattern(`re:^(spell|legend)\b`)}, Exclude: []SetPattern{pattern("legend-*")}}
+	if selected := names(filter.Select(sets, nil)); selected != "metal-raiders,spell-ruler" {
+		t.Fatal("Expected: metal-raiders,spell-ruler  Got:", selected)
+	}
+	filter = SetFilter{MinCards: 100, MaxCards: 130}
+	if selected := names(filter.Select(sets, nil)); selected != "legend-of-blue-eyes-white-dragon,spell-ruler" {
+		t.Fatal("Expected sets with 100 to 130 cards  Got:", selected)
+	}
+
+	since, err := ParseSince("2021-07-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSeen := map[string]time.Time{
+		"legend-of-blue-eyes-white-dragon": since.AddDate(-1, 0, 0),
+		"metal-raiders":                    since.AddDate(-1, 0, 0),
+		"duelist-league-promo":             since.AddDate(0, 0, 3),
+	}
+	filter = SetFilter{AddedSince: since}
+	if selected := names(filter.Select(sets, firstSeen)); selected != "duelist-league-promo,spell-ruler" {
+		t.Fatal("Expected the sets seen since 2021-07-01 and the unknown set  Got:", selected)
+	}
+
+	if _, err = ParseSetPattern("re:("); err == nil {
+		t.Fatal("Expected an error for an invalid regular expression")
+	}
+	if _, err = ParseSince("July 1st"); err == nil {
+		t.Fatal("Expected an error for an invalid date")
+	}
+}
+
+// TEST: RecordKnownSets keeps the time a set was first seen
+func TestKnownSets(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	first := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	sets := []itemInfo{{Value: "Metal Raiders", URLValue: "metal-raiders"}}
+	if err := RecordKnownSets(db, "YuGiOh", sets, first); err != nil {
+		t.Fatal(err)
+	}
+	sets = append(sets, itemInfo{Value: "Spell Ruler", URLValue: "spell-ruler"})
+	if err := RecordKnownSets(db, "yugioh", sets, first.AddDate(0, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	firstSeen, err := FirstSeenSets(db, "YuGiOh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(firstSeen) != 2 || !firstSeen["metal-raiders"].Equal(first) || !firstSeen["spell-ruler"].After(first) {
+		t.Fatal("Expected metal-raiders to keep its first seen time  Got:", firstSeen)
+	}
+
+	// TEST: The known sets migration records the stored sets as known sets
+	seedProductLine(t, db, "Magic", 1)
+	if err = backfillKnownSets(db, first); err != nil {
+		t.Fatal(err)
+	}
+	firstSeen, _ = FirstSeenSets(db, "Magic")
+	if !firstSeen["Magic-set"].Equal(first) {
+		t.Fatal("Expected the stored set to be backfilled  Got:", firstSeen)
+	}
+}
+
+// TEST: A set released after the last scrape is new although the scrape stores the sets first
+func TestScrapeNewSet(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	defer func() { currentRun = nil }()
+
+	response := &ResponsePayload{Results: []Result{{Aggregations: aggregation{
+		ProductLineName: []itemInfo{{Value: "YuGiOh", URLValue: "YuGiOh", IsActive: true}},
+		SetName:         []itemInfo{{Value: "Metal Raiders", URLValue: "metal-raiders", Count: 2}},
+	}}}}
+	scrape := func(filter *SetFilter) ([]itemInfo, *Run) {
+		if tx := WriteProductLineInfo(db, response.Results[0]); tx.Error != nil {
+			t.Fatal(tx.Error)
+		}
+		if tx := WriteSetInfo(db, response.Results[0].Aggregations); tx.Error != nil {
+			t.Fatal(tx.Error)
+		}
+		run := StartRun("scrape", []string{"YuGiOh"}, NotifyConfig{})
+		return filterSets(db, "YuGiOh", response, filter, run), run
+	}
+	scrape(&SetFilter{})
+
+	since := time.Now()
+	aggregations := &response.Results[0].Aggregations
+	aggregations.SetName = append(aggregations.SetName, itemInfo{Value: "Spell Ruler", URLValue: "spell-ruler", Count: 1})
+	selected, run := scrape(&SetFilter{AddedSince: since})
+	if len(selected) != 1 || selected[0].URLValue != "spell-ruler" {
+		t.Fatal("Expected the new set to be selected  Got:", selected)
+	}
+	if len(run.summary.NewSets) != 1 || run.summary.NewSets[0].URLName != "spell-ruler" {
+		t.Fatal("Expected the new set to be reported  Got:", run.summary.NewSets)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is read by LoadConfig when no config file is given and the file exists.
+const DefaultConfigFile = "scraper.yaml"
+
+// config is the configuration of the running command. It is loaded by main and
+// overridden by the flags of the command, see parseFlags.
+var config = DefaultConfig()
+
+// Config holds the settings of the scraper. Settings are read from a YAML config file
+// and overridden by environment variables and command line flags, in that order.
+type Config struct {
+	Database     DataSourceName `yaml:"database"`
+	HTTP         HTTPConfig     `yaml:"http"`
+	Workers      int            `yaml:"workers"`    // Concurrent requests and database writers
+	BatchSize    int            `yaml:"batch_size"` // See InsertBatchSize
+	Images       ImageConfig    `yaml:"images"`
+	ProductLines []string       `yaml:"product_lines"` // Used by scrape and prices when no product line is named
+	Sinks        SinkConfig     `yaml:"sinks"`
+	Notify       NotifyConfig   `yaml:"notify"`
+}
+
+// HTTPConfig holds the settings of requests to tcgplayer.
+type HTTPConfig struct {
+	Timeout   int     `yaml:"timeout"`    // Request timeout in seconds
+	RateLimit float64 `yaml:"rate_limit"` // Maximum API requests per second, zero for no limit
+}
+
+// ImageConfig holds the settings of the image stage.
+type ImageConfig struct {
+	Store        string   `yaml:"store"` // See OpenBlobStore
+	Variants     []string `yaml:"variants"`
+	Derivatives  []string `yaml:"derivatives"`
+	BatchSize    int      `yaml:"batch_size"` // See ImageBatchSize
+	SkipExisting bool     `yaml:"skip_existing"`
+	RateLimit    float64  `yaml:"rate_limit"` // Maximum image requests per second, zero for no limit
+}
+
+// SinkConfig holds the sinks scraped card listings are written to besides the
+// database, see FanOut.
+type SinkConfig struct {
+	Archive SinkTarget `yaml:"archive"` // Target is the directory of a JSONLArchive
+	Webhook SinkTarget `yaml:"webhook"` // Target is the URL of a WebhookSink
+}
+
+// SinkTarget holds the settings of a sink, see SinkOptions. The sink is not used if
+// Target is empty.
+type SinkTarget struct {
+	Target       string `yaml:"target"`
+	Buffer       int    `yaml:"buffer"`   // Batches queued before the scrape waits for the sink
+	OnError      string `yaml:"on_error"` // fail, skip or disable
+	DropWhenFull bool   `yaml:"drop_when_full"`
+	Retries      int    `yaml:"retries"` // Retries of a failed batch, webhook sink only
+}
+
+// Options returns the options of the sink.
+func (t SinkTarget) Options() SinkOptions {
+	return SinkOptions{Buffer: t.Buffer, OnError: t.OnError, DropWhenFull: t.DropWhenFull}
+}
+
+// validate returns the problems of the settings of the sink named name.
+func (t SinkTarget) validate(name string) []string {
+	var problems []string
+	if t.Buffer < 0 {
+		problems = append(problems, name+".buffer: must not be negative")
+	}
+	if t.Retries < 0 {
+		problems = append(problems, name+".retries: must not be negative")
+	}
+	switch t.OnError {
+	case "", SinkFail, SinkSkip, SinkDisable:
+	default:
+		problems = append(problems, fmt.Sprintf("%s.on_error: must be one of %s", name, strings.Join(SinkErrorPolicies, ", ")))
+	}
+	return problems
+}
+
+// NotifyConfig holds the webhooks notified when a scrape or prices run finishes, see Run.
+type NotifyConfig struct {
+	Targets         []WebhookTarget `yaml:"targets"`
+	Retries         int             `yaml:"retries"`           // Retries of a failed notification
+	PriceChange     float64         `yaml:"price_change"`      // Smallest reported price move in percent
+	TopPriceChanges int             `yaml:"top_price_changes"` // Price moves per notification
+}
+
+// WebhookTarget is a URL notifications are posted to.
+type WebhookTarget struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // Key of the SignatureHeader, unsigned if empty
+	Events []string `yaml:"events"` // See NotifyEvents, all if empty
+}
+
+// DefaultConfig returns the configuration used when nothing else is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Database:  DataSourceName{Driver: "mysql", Charset: "utf8mb4", ParseTime: true},
+		HTTP:      HTTPConfig{Timeout: DefaultTimeout},
+		Workers:   runtime.NumCPU() * 2,
+		BatchSize: InsertBatchSize,
+		Images:    ImageConfig{Variants: []string{"200w"}, BatchSize: ImageBatchSize},
+		Sinks: SinkConfig{
+			Archive: SinkTarget{OnError: SinkFail},
+			Webhook: SinkTarget{Buffer: 16, OnError: SinkSkip, Retries: 3},
+		},
+		Notify: NotifyConfig{Retries: 3, PriceChange: 20, TopPriceChanges: 10},
+	}
+}
+
+// LoadConfig returns the default configuration overridden by the YAML file at path and
+// by the environment. If path is empty, DefaultConfigFile is read if it exists. A .env
+// file in the working directory is loaded into the environment first.
+//
+// The environment variables are TCG_DB_DRIVER, TCG_DB_HOST, TCG_DB_PORT, TCG_DB_USER,
+// TCG_DB_PASSWD, TCG_DB_PASSWD_FILE, TCG_DB_NAME, TCG_DB_CHARSET, TCG_DB_TIMEZONE,
+// TCG_DB_TLS (the TLS mode), TCG_DB_TLS_CA, TCG_DB_TLS_CERT, TCG_DB_TLS_KEY,
+// TCG_WORKERS, TCG_BATCH_SIZE, TCG_HTTP_TIMEOUT, TCG_RATE_LIMIT, TCG_IMAGE_STORE (or
+// TCG_IMAGES for a directory), TCG_IMAGE_VARIANTS, TCG_IMAGE_DERIVATIVES,
+// TCG_IMAGE_RATE_LIMIT, TCG_PRODUCT_LINES, TCG_SINK_ARCHIVE and TCG_SINK_WEBHOOK. Lists
+// are comma separated. TCG_NOTIFY_URL adds a webhook target notified of every event,
+// signed with TCG_NOTIFY_SECRET if it is set. If a password file is configured, the
+// password is read from it.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		if _, err := os.Stat(DefaultConfigFile); err == nil {
+			path = DefaultConfigFile
+		}
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(data, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+	godotenv.Load()
+	err := cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Database.readPasswordFile()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readPasswordFile sets the password to the contents of the password file, if one is
+// given. A trailing newline is dropped.
+func (dsn *DataSourceName) readPasswordFile() error {
+	if dsn.PasswordFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(dsn.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("database.password_file: %v", err)
+	}
+	dsn.Password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// loadEnv overrides the settings that are set in the environment, see LoadConfig.
+func (cfg *Config) loadEnv() error {
+	if value, ok := os.LookupEnv("TCG_IMAGES"); ok {
+		cfg.Images.Store = value
+	}
+	strs := map[string]*string{
+		"TCG_DB_DRIVER":      &cfg.Database.Driver,
+		"TCG_DB_HOST":        &cfg.Database.Host,
+		"TCG_DB_PORT":        &cfg.Database.Port,
+		"TCG_DB_USER":        &cfg.Database.User,
+		"TCG_DB_PASSWD":      &cfg.Database.Password,
+		"TCG_DB_PASSWD_FILE": &cfg.Database.PasswordFile,
+		"TCG_DB_NAME":        &cfg.Database.Database,
+		"TCG_DB_CHARSET":     &cfg.Database.Charset,
+		"TCG_DB_TIMEZONE":    &cfg.Database.Timezone,
+		"TCG_DB_TLS":         &cfg.Database.TLS.Mode,
+		"TCG_DB_TLS_CA":      &cfg.Database.TLS.CA,
+		"TCG_DB_TLS_CERT":    &cfg.Database.TLS.Cert,
+		"TCG_DB_TLS_KEY":     &cfg.Database.TLS.Key,
+		"TCG_IMAGE_STORE":    &cfg.Images.Store,
+		"TCG_SINK_ARCHIVE":   &cfg.Sinks.Archive.Target,
+		"TCG_SINK_WEBHOOK":   &cfg.Sinks.Webhook.Target,
+	}
+	for name, field := range strs {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+	lists := map[string]*[]string{
+		"TCG_IMAGE_VARIANTS":    &cfg.Images.Variants,
+		"TCG_IMAGE_DERIVATIVES": &cfg.Images.Derivatives,
+		"TCG_PRODUCT_LINES":     &cfg.ProductLines,
+	}
+	for name, field := range lists {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = splitList(value)
+		}
+	}
+	if value, ok := os.LookupEnv("TCG_NOTIFY_URL"); ok {
+		cfg.Notify.Targets = append(cfg.Notify.Targets, WebhookTarget{URL: value, Secret: os.Getenv("TCG_NOTIFY_SECRET")})
+	}
+	ints := map[string]*int{
+		"TCG_WORKERS":      &cfg.Workers,
+		"TCG_BATCH_SIZE":   &cfg.BatchSize,
+		"TCG_HTTP_TIMEOUT": &cfg.HTTP.Timeout,
+	}
+	for name, field := range ints {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", name, value)
+			}
+			*field = n
+		}
+	}
+	floats := map[string]*float64{
+		"TCG_RATE_LIMIT":       &cfg.HTTP.RateLimit,
+		"TCG_IMAGE_RATE_LIMIT": &cfg.Images.RateLimit,
+	}
+	for name, field := range floats {
+		if value, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", name, value)
+			}
+			*field = f
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration and returns an error describing every invalid setting.
+func (cfg *Config) Validate() error {
+	return cfg.validate(true)
+}
+
+// validate checks the configuration, see Validate. The database settings are only
+// checked if database is set.
+func (cfg *Config) validate(database bool) error {
+	var problems []string
+	if database {
+		problems = cfg.Database.validateConnection()
+	}
+	if cfg.Workers < 1 {
+		problems = append(problems, "workers: must be greater than zero")
+	}
+	if cfg.BatchSize < 1 {
+		problems = append(problems, "batch_size: must be greater than zero")
+	}
+	if cfg.HTTP.Timeout < 1 {
+		problems = append(problems, "http.timeout: must be greater than zero")
+	}
+	if cfg.HTTP.RateLimit < 0 {
+		problems = append(problems, "http.rate_limit: must not be negative")
+	}
+	if _, err := ParseImageVariants(strings.Join(cfg.Images.Variants, ",")); err != nil {
+		problems = append(problems, "images.variants: "+err.Error())
+	}
+	if _, err := ParseImageDerivatives(strings.Join(cfg.Images.Derivatives, ",")); err != nil {
+		problems = append(problems, "images.derivatives: "+err.Error())
+	}
+	if cfg.Images.BatchSize < 1 {
+		problems = append(problems, "images.batch_size: must be greater than zero")
+	}
+	if cfg.Images.RateLimit < 0 {
+		problems = append(problems, "images.rate_limit: must not be negative")
+	}
+	problems = append(problems, cfg.Sinks.Archive.validate("sinks.archive")...)
+	problems = append(problems, cfg.Sinks.Webhook.validate("sinks.webhook")...)
+	if cfg.Sinks.Webhook.Target != "" {
+		if err := validateWebhookURL(cfg.Sinks.Webhook.Target); err != nil {
+			problems = append(problems, "sinks.webhook.target: "+err.Error())
+		}
+	}
+	if cfg.Notify.Retries < 0 {
+		problems = append(problems, "notify.retries: must not be negative")
+	}
+	if cfg.Notify.PriceChange < 0 {
+		problems = append(problems, "notify.price_change: must not be negative")
+	}
+	if cfg.Notify.TopPriceChanges < 0 {
+		problems = append(problems, "notify.top_price_changes: must not be negative")
+	}
+	for i, target := range cfg.Notify.Targets {
+		if err := validateWebhookURL(target.URL); err != nil {
+			problems = append(problems, fmt.Sprintf("notify.targets[%d].url: %v", i, err))
+		}
+		for _, event := range target.Events {
+			switch event {
+			case EventCompleted, EventFailed, EventNewSets, EventPriceMoves:
+			default:
+				problems = append(problems, fmt.Sprintf("notify.targets[%d].events: unknown event %q, expected one of %s", i, event, strings.Join(NotifyEvents, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Apply copies the configuration to the package settings it controls. The configuration
+// must be valid, see Validate.
+func (cfg *Config) Apply() {
+	DefaultTimeout = cfg.HTTP.Timeout
+	InsertBatchSize = cfg.BatchSize
+	ImageBatchSize = cfg.Images.BatchSize
+	SkipExistingImages = cfg.Images.SkipExisting
+	ImageVariants, _ = ParseImageVariants(strings.Join(cfg.Images.Variants, ","))
+	ImageDerivatives, _ = ParseImageDerivatives(strings.Join(cfg.Images.Derivatives, ","))
+	TcgpRateLimiter = NewRateLimiter(cfg.HTTP.RateLimit)
+	ImageRateLimiter = NewRateLimiter(cfg.Images.RateLimit)
+}
+
+// Redacted returns a copy of the configuration without secrets.
+func (cfg *Config) Redacted() *Config {
+	redacted := *cfg
+	if redacted.Database.Password != "" {
+		redacted.Database.Password = "REDACTED"
+	}
+	if len(cfg.Database.Params) > 0 {
+		redacted.Database.Params = make(map[string]string, len(cfg.Database.Params))
+		for key := range cfg.Database.Params {
+			redacted.Database.Params[key] = "REDACTED" // Driver parameters may hold credentials
+		}
+	}
+	if redacted.Sinks.Webhook.Target != "" {
+		redacted.Sinks.Webhook.Target = redactURL(redacted.Sinks.Webhook.Target)
+	}
+	redacted.Notify.Targets = make([]WebhookTarget, len(cfg.Notify.Targets))
+	for i, target := range cfg.Notify.Targets {
+		target.URL = redactURL(target.URL)
+		if target.Secret != "" {
+			target.Secret = "REDACTED"
+		}
+		redacted.Notify.Targets[i] = target
+	}
+	return &redacted
+}
+
+// Show writes the configuration as YAML to w, with secrets redacted.
+func (cfg *Config) Show(w io.Writer) error {
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(list string) []string {
+	var elems []string
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// listFlag is a flag.Value that sets a list from a comma separated string.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = splitList(value)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TEST: LoadConfig reads the config file, the environment overrides it
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	os.Chdir(dir) // Keep the .env file of the repository out of the test
+	defer os.Chdir(wd)
+
+	file := filepath.Join(dir, "scraper.yaml")
+	ioutil.WriteFile(file, []byte(`
+database:
+  host: db.example.com
+  port: "3306"
+  user: scraper
+  password: secret
+  database: tcg
+  params:
+    sslpassword: secret
+workers: 4
+images:
+  store: cas:///var/images
+  variants: [200w, 400w]
+product_lines: [YuGiOh]
+`), 0644)
+	os.Setenv("TCG_WORKERS", "8")
+	os.Setenv("TCG_IMAGE_DERIVATIVES", "100w, png")
+	defer os.Unsetenv("TCG_WORKERS")
+	defer os.Unsetenv("TCG_IMAGE_DERIVATIVES")
+
+	cfg, err := LoadConfig("") // Finds scraper.yaml in the working directory
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Host != "db.example.com" || cfg.Workers != 8 || cfg.HTTP.Timeout != DefaultTimeout {
+		t.Fatalf("Unexpected configuration: %+v", cfg)
+	}
+	if len(cfg.Images.Variants) != 2 || len(cfg.Images.Derivatives) != 2 || cfg.ProductLines[0] != "YuGiOh" {
+		t.Fatalf("Unexpected image configuration: %+v", cfg.Images)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	cfg.Show(&out)
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), "password: REDACTED") {
+		t.Fatal("Expected the password to be redacted  Got:", out.String())
+	}
+	if cfg.Database.Password != "secret" {
+		t.Fatal("Redacted modified the configuration")
+	}
+
+	// TEST: Redacted leaves only the scheme and host of webhook URLs
+	cfg.Sinks.Webhook.Target = "https://hooks.example.com/token123"
+	cfg.Notify.Targets = []WebhookTarget{{URL: "https://notify.example.com/services/token456?key=789"}}
+	out.Reset()
+	cfg.Show(&out)
+	if strings.Contains(out.String(), "token") || !strings.Contains(out.String(), "https://notify.example.com") {
+		t.Fatal("Expected the webhook URLs to be redacted  Got:", out.String())
+	}
+
+	cfg.Workers = 0
+	cfg.Images.Variants = []string{"big"}
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "workers") || !strings.Contains(err.Error(), "images.variants") {
+		t.Fatal("Expected errors for workers and images.variants  Got:", err)
+	}
+
+	ioutil.WriteFile(file, []byte("database:\n  hots: typo\n"), 0644)
+	if _, err = LoadConfig(file); err == nil {
+		t.Fatal("Expected an error for an unknown setting")
+	}
+}
+
+// TEST: LoadConfig reads the password from the file named by TCG_DB_PASSWD_FILE
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	secret := filepath.Join(dir, "db_password")
+	ioutil.WriteFile(secret, []byte("from-file\n"), 0600)
+	os.Setenv("TCG_DB_PASSWD", "from-env")
+	os.Setenv("TCG_DB_PASSWD_FILE", secret)
+	defer os.Unsetenv("TCG_DB_PASSWD")
+	defer os.Unsetenv("TCG_DB_PASSWD_FILE")
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Password != "from-file" {
+		t.Fatal("Expected password: from-file  Got:", cfg.Database.Password)
+	}
+
+	os.Setenv("TCG_DB_PASSWD_FILE", filepath.Join(dir, "missing"))
+	if _, err = LoadConfig(""); err == nil || !strings.Contains(err.Error(), "password_file") {
+		t.Fatal("Expected an error for a missing password file  Got:", err)
+	}
+}
+
+// TEST: RateLimiter spaces events
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		limiter.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("Expected 6 events to take at least 50ms  Got:", elapsed)
+	}
+	var unlimited *RateLimiter
+	unlimited.Wait() // Does not block or panic
+	if NewRateLimiter(0) != nil {
+		t.Fatal("Expected no limiter for a rate of zero")
+	}
+}
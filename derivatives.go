@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// ImageDerivatives lists the images generated from every downloaded image variant,
+// see ImageDerivative. No derivatives are generated by default.
+var ImageDerivatives []ImageDerivative
+
+// ImageDerivative describes an image generated locally from a downloaded image variant,
+// such as a thumbnail or a PNG copy.
+type ImageDerivative struct {
+	Width  int    // Width in pixels, zero keeps the width of the source image
+	Format string // File format, png or jpg
+}
+
+// ParseImageDerivatives parses a comma separated list of image derivatives. Every
+// element is a width such as 100w, optionally followed by a format as in 100w.png, or
+// a format alone for a full size copy. Thumbnails default to the jpg format.
+func ParseImageDerivatives(list string) ([]ImageDerivative, error) {
+	var derivatives []ImageDerivative
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		derivative := ImageDerivative{Format: "jpg"}
+		size := elem
+		if i := strings.Index(elem, "."); i != -1 {
+			size, derivative.Format = elem[:i], elem[i+1:]
+		} else if !variantPattern.MatchString(elem) {
+			size, derivative.Format = "", elem
+		}
+		if size != "" {
+			if !variantPattern.MatchString(size) {
+				return nil, fmt.Errorf("invalid image derivative %q, expected a width such as 100w", elem)
+			}
+			fmt.Sscanf(size, "%dw", &derivative.Width)
+		}
+		switch derivative.Format {
+		case "png", "jpg":
+		case "webp":
+			return nil, errors.New("webp derivatives are not supported: there is no pure Go WebP encoder, use png instead")
+		default:
+			return nil, fmt.Errorf("invalid image derivative format %q, expected png or jpg", derivative.Format)
+		}
+		if derivative.Width == 0 && derivative.Format == "jpg" {
+			return nil, fmt.Errorf("image derivative %q would be a copy of the downloaded image", elem)
+		}
+		derivatives = append(derivatives, derivative)
+	}
+	return derivatives, nil
+}
+
+// Name returns the canonical form of the derivative, e.g. 100w.jpg or png.
+func (d ImageDerivative) Name() string {
+	if d.Width == 0 {
+		return d.Format
+	}
+	return fmt.Sprintf("%dw.%s", d.Width, d.Format)
+}
+
+// Variant returns the image manifest variant of the derivative of source, e.g. 200w:100w.jpg.
+func (d ImageDerivative) Variant(source ImageVariant) ImageVariant {
+	return ImageVariant(string(source) + ":" + d.Name())
+}
+
+// LocalName returns the file name under which the derivative of a card image variant is
+// stored, next to the source image. E.g. 7_200w_100w.jpg, or 7_200w.png for a full size copy.
+func (d ImageDerivative) LocalName(source ImageVariant, cardID uint) string {
+	if d.Width == 0 {
+		return fmt.Sprintf("%d_%s.%s", cardID, source, d.Format)
+	}
+	return fmt.Sprintf("%d_%s_%dw.%s", cardID, source, d.Width, d.Format)
+}
+
+// Render scales src down to the width of the derivative, keeping its aspect ratio, and
+// encodes the result. Images narrower than the derivative are not scaled up.
+func (d ImageDerivative) Render(src image.Image) ([]byte, image.Rectangle, error) {
+	var dst image.Image = src
+	bounds := src.Bounds()
+	if d.Width > 0 && d.Width < bounds.Dx() {
+		height := bounds.Dy() * d.Width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, d.Width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, bounds, draw.Src, nil)
+		dst = scaled
+	}
+
+	var buff bytes.Buffer
+	var err error
+	if d.Format == "png" {
+		err = png.Encode(&buff, dst)
+	} else {
+		err = jpeg.Encode(&buff, dst, &jpeg.Options{Quality: 90})
+	}
+	return buff.Bytes(), dst.Bounds(), err
+}
+
+// deriveImages generates derivatives of the image described by source and writes them to
+// store. The returned records describe the stored derivatives.
+func deriveImages(store BlobStore, source ImageRecord, derivatives []ImageDerivative) ([]ImageRecord, error) {
+	if len(derivatives) == 0 {
+		return nil, nil
+	}
+	data, err := store.Get(source.Path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ImageRecord
+	for _, derivative := range derivatives {
+		out, bounds, err := derivative.Render(src)
+		if err != nil {
+			return records, err
+		}
+		location, err := store.Put(derivative.LocalName(ImageVariant(source.Variant), source.CardID), out)
+		if err != nil {
+			return records, err
+		}
+		sum := sha256.Sum256(out)
+		records = append(records, ImageRecord{
+			CardID:    source.CardID,
+			ProductID: source.ProductID,
+			Variant:   string(derivative.Variant(ImageVariant(source.Variant))),
+			Path:      location,
+			Size:      int64(len(out)),
+			SHA256:    hex.EncodeToString(sum[:]),
+			Width:     bounds.Dx(),
+			Height:    bounds.Dy(),
+			FetchedAt: time.Now(),
+		})
+	}
+	return records, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TEST: ParseImageDerivatives accepts thumbnails and format copies
+func TestParseImageDerivatives(t *testing.T) {
+	derivatives, err := ParseImageDerivatives("100w, 300w.png,png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ImageDerivative{{100, "jpg"}, {300, "png"}, {0, "png"}}
+	if len(derivatives) != len(expected) {
+		t.Fatal("Expected:", expected, " Got:", derivatives)
+	}
+	for i := range expected {
+		if derivatives[i] != expected[i] {
+			t.Fatal("Expected:", expected, " Got:", derivatives)
+		}
+	}
+	for _, list := range []string{"100", "100w.gif", "jpg", "webp"} {
+		if _, err = ParseImageDerivatives(list); err == nil {
+			t.Fatal("Expected an error for:", list)
+		}
+	}
+}
+
+// TEST: deriveImages stores scaled derivatives next to the source image
+func TestDeriveImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buff bytes.Buffer
+	jpeg.Encode(&buff, image.NewRGBA(image.Rect(0, 0, 8, 12)), nil)
+	location, err := store.Put("7_200w.jpg", buff.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := ImageRecord{CardID: 7, ProductID: 42, Variant: "200w", Path: location}
+	derivatives := []ImageDerivative{{4, "png"}, {0, "png"}}
+	records, err := deriveImages(store, source, derivatives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Path != "7_200w_4w.png" || records[0].Variant != "200w:4w.png" || records[1].Path != "7_200w.png" {
+		t.Fatalf("Unexpected derivative records: %+v", records)
+	}
+	data, err := store.Get(records[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnail, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail.Bounds().Dx() != 4 || thumbnail.Bounds().Dy() != 6 || records[0].Height != 6 {
+		t.Fatal("Expected a 4x6 thumbnail  Got:", thumbnail.Bounds())
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Dialect hides the parts of the database schema management that differ between
+// the supported database servers.
+type Dialect interface {
+	// Name returns the DSN scheme of the dialect, which is also the name of the
+	// corresponding gorm dialector.
+	Name() string
+
+	// Open returns a gorm dialector for the driver specific data source string.
+	Open(dsn string) gorm.Dialector
+
+	// TableNames returns the names of all tables in the current database.
+	TableNames(db *gorm.DB) ([]string, error)
+
+	// DropTables drops the named tables, ignoring foreign key constraints between them.
+	DropTables(db *gorm.DB, names ...string) error
+
+	// PrepareSchema runs the dialect specific DDL needed after the tables are created.
+	PrepareSchema(db *gorm.DB) error
+
+	// RevertSchema undoes the changes made by PrepareSchema.
+	RevertSchema(db *gorm.DB) error
+}
+
+// dialects maps DSN schemes to the corresponding Dialect implementation.
+var dialects = map[string]Dialect{
+	"mysql":      mysqlDialect{},
+	"postgres":   postgresDialect{},
+	"postgresql": postgresDialect{},
+	"sqlite":     sqliteDialect{},
+}
+
+// ParseDSN splits a data source URL of the form <scheme>://<data source> into its
+// Dialect and the data source string understood by the corresponding driver.
+// Strings without a scheme are treated as MySQL data sources.
+func ParseDSN(dsn string) (Dialect, string, error) {
+	i := strings.Index(dsn, "://")
+	if i == -1 {
+		return mysqlDialect{}, dsn, nil
+	}
+	scheme := strings.ToLower(dsn[:i])
+	dialect, ok := dialects[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported database scheme %q", scheme)
+	}
+	switch dialect.(type) {
+	case postgresDialect:
+		return dialect, dsn, nil // pgx understands postgres URLs
+	default:
+		return dialect, dsn[i+3:], nil
+	}
+}
+
+// RedactDSN returns dsn with its password replaced by REDACTED, so that it can be
+// logged. Both URL and MySQL style data sources are understood, see ParseDSN.
+func RedactDSN(dsn string) string {
+	start, end := dsnPassword(dsn)
+	if start == end {
+		return dsn
+	}
+	return dsn[:start] + "REDACTED" + dsn[end:]
+}
+
+// RedactError returns err with every occurrence of the password of dsn replaced by
+// REDACTED. Driver errors may quote the data source they failed to parse.
+func RedactError(err error, dsn string) error {
+	start, end := dsnPassword(dsn)
+	if err == nil || start == end {
+		return err
+	}
+	msg := err.Error()
+	password := dsn[start:end]
+	if unescaped, uerr := url.PathUnescape(password); uerr == nil && unescaped != password {
+		msg = strings.ReplaceAll(msg, unescaped, "REDACTED")
+	}
+	msg = strings.ReplaceAll(msg, password, "REDACTED")
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// dsnPassword returns the offsets of the password in dsn. Like the MySQL driver, the
+// user info is taken to end at the last '@' before the last '/', so passwords may
+// contain '@'. Offsets are equal if dsn has no password.
+func dsnPassword(dsn string) (int, int) {
+	offset := 0
+	if i := strings.Index(dsn, "://"); i != -1 {
+		if strings.ToLower(dsn[:i]) == "sqlite" {
+			return 0, 0 // A file path, which may contain '@'
+		}
+		offset = i + 3
+	}
+	rest := dsn[offset:]
+	if slash := strings.LastIndex(rest, "/"); slash != -1 {
+		rest = rest[:slash]
+	}
+	at := strings.LastIndex(rest, "@")
+	if at == -1 {
+		return 0, 0
+	}
+	colon := strings.Index(rest[:at], ":")
+	if colon == -1 {
+		return 0, 0
+	}
+	return offset + colon + 1, offset + at
+}
+
+// DialectOf returns the Dialect of an open database connection.
+func DialectOf(db *gorm.DB) (Dialect, error) {
+	dialect, ok := dialects[db.Dialector.Name()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database dialect %q", db.Dialector.Name())
+	}
+	return dialect, nil
+}
+
+// dropTables drops the named tables one at a time.
+func dropTables(db *gorm.DB, sql string, names []string) error {
+	for _, name := range names {
+		tx := db.Exec(sql, clause.Table{Name: name})
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+	return nil
+}
+
+/*****************************************************************************************/
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return "mysql" }
+
+func (mysqlDialect) Open(dsn string) gorm.Dialector { return mysql.Open(dsn) }
+
+func (mysqlDialect) TableNames(db *gorm.DB) ([]string, error) {
+	var names []string
+	tx := db.Raw(
+		"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?",
+		db.Migrator().CurrentDatabase(),
+	).Scan(&names)
+	return names, tx.Error
+}
+
+func (mysqlDialect) DropTables(db *gorm.DB, names ...string) error {
+	// FOREIGN_KEY_CHECKS is a session variable, so the statements have to run on a single connection.
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0").Error; err != nil {
+			return err
+		}
+		defer tx.Exec("SET FOREIGN_KEY_CHECKS = 1")
+		return dropTables(tx, "DROP TABLE IF EXISTS ?", names)
+	})
+}
+
+func (mysqlDialect) PrepareSchema(db *gorm.DB) error {
+	return db.Exec("ALTER TABLE yu_gi_oh_card_infos MODIFY description TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci").Error
+}
+
+func (mysqlDialect) RevertSchema(db *gorm.DB) error {
+	return db.Exec("ALTER TABLE yu_gi_oh_card_infos MODIFY description TEXT").Error // Back to the table's default character set
+}
+
+/*****************************************************************************************/
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) Open(dsn string) gorm.Dialector { return postgres.Open(dsn) }
+
+func (postgresDialect) TableNames(db *gorm.DB) ([]string, error) {
+	var names []string
+	tx := db.Raw("SELECT tablename FROM pg_tables WHERE schemaname = CURRENT_SCHEMA()").Scan(&names)
+	return names, tx.Error
+}
+
+func (postgresDialect) DropTables(db *gorm.DB, names ...string) error {
+	return dropTables(db, "DROP TABLE IF EXISTS ? CASCADE", names)
+}
+
+func (postgresDialect) PrepareSchema(db *gorm.DB) error {
+	return nil // Text columns use the database encoding, which is expected to be UTF8
+}
+
+func (postgresDialect) RevertSchema(db *gorm.DB) error { return nil }
+
+/*****************************************************************************************/
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) Open(dsn string) gorm.Dialector { return sqlite.Open(dsn) }
+
+func (sqliteDialect) TableNames(db *gorm.DB) ([]string, error) {
+	var names []string
+	tx := db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'").Scan(&names)
+	return names, tx.Error
+}
+
+func (sqliteDialect) DropTables(db *gorm.DB, names ...string) error {
+	// Foreign key enforcement is off unless enabled per connection, so the order does not matter.
+	return dropTables(db, "DROP TABLE IF EXISTS ?", names)
+}
+
+func (sqliteDialect) PrepareSchema(db *gorm.DB) error {
+	return nil // SQLite stores all text as UTF-8
+}
+
+func (sqliteDialect) RevertSchema(db *gorm.DB) error { return nil }
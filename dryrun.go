@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// errImageChanged is returned by revalidateImage for images that differ from the stored ones.
+var errImageChanged = errors.New("image changed")
+
+// SetChanges counts the cards and card images of a set that a scrape would add, rewrite
+// or leave as they are.
+type SetChanges struct {
+	NewCards        int
+	ChangedCards    int
+	UnchangedCards  int
+	NewImages       int
+	ChangedImages   int
+	UnchangedImages int
+}
+
+// add adds the counts of other to changes.
+func (changes *SetChanges) add(other SetChanges) {
+	changes.NewCards += other.NewCards
+	changes.ChangedCards += other.ChangedCards
+	changes.UnchangedCards += other.UnchangedCards
+	changes.NewImages += other.NewImages
+	changes.ChangedImages += other.ChangedImages
+	changes.UnchangedImages += other.UnchangedImages
+}
+
+// DryRunReport collects the SetChanges of a scrape that does not write to the database.
+// It is safe for concurrent use.
+type DryRunReport struct {
+	// Store is the image store the images of known cards are checked against. Images
+	// are not counted if Store is nil.
+	Store  BlobStore
+	client *http.Client
+	mu     sync.Mutex
+	sets   map[string]*SetChanges
+}
+
+// NewDryRunReport returns an empty report. Images are checked against store unless it
+// is nil, see DryRunReport.
+func NewDryRunReport(store BlobStore) *DryRunReport {
+	return &DryRunReport{
+		Store:  store,
+		client: &http.Client{Timeout: time.Duration(DefaultTimeout) * time.Second},
+		sets:   make(map[string]*SetChanges),
+	}
+}
+
+// Add adds changes to the counts of the named set.
+func (report *DryRunReport) Add(set string, changes SetChanges) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.sets[set] == nil {
+		report.sets[set] = &SetChanges{}
+	}
+	report.sets[set].add(changes)
+}
+
+// Changes returns the counts of the named set.
+func (report *DryRunReport) Changes(set string) SetChanges {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.sets[set] == nil {
+		return SetChanges{}
+	}
+	return *report.sets[set]
+}
+
+// Print writes the counts of every set, ordered by set name, and their totals to w.
+func (report *DryRunReport) Print(w io.Writer) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	names := make([]string, 0, len(report.sets))
+	for name := range report.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	format := "%-60s %9v %9v %9v %9v %9v %9v\n"
+	fmt.Fprintf(w, format, "SET", "NEW", "CHANGED", "UNCHANGED", "NEW IMG", "CHG IMG", "SAME IMG")
+	var total SetChanges
+	for _, name := range names {
+		c := report.sets[name]
+		fmt.Fprintf(w, format, name, c.NewCards, c.ChangedCards, c.UnchangedCards, c.NewImages, c.ChangedImages, c.UnchangedImages)
+		total.add(*c)
+	}
+	fmt.Fprintf(w, format, "TOTAL", total.NewCards, total.ChangedCards, total.UnchangedCards, total.NewImages, total.ChangedImages, total.UnchangedImages)
+}
+
+// ReportCardInfo is meant to be executed as a goroutine in place of WriteCardInfo. It
+// reads card info data from dataChan and compares it with the cards stored in db,
+// adding the result to report. Nothing is written to the database. A scrape inserts the
+// new cards, updates the changed ones and leaves the unchanged ones alone, see
+// writeCardInfo.
+func ReportCardInfo(wg *sync.WaitGroup, dataChan chan []CardAttrs, db *gorm.DB, setMap map[string]tcm.SetInfo, report *DryRunReport) {
+	defer wg.Done()
+
+	for true {
+		data := <-dataChan
+		if data == nil {
+			break
+		}
+		cardInfoList, err := makeCardInfoList(data, setMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		changes, err := compareCards(db, data, cardInfoList, report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.Add(data[0].SetName, changes)
+	}
+}
+
+// compareCards counts the scraped cards in cardInfoList, see makeCardInfoList, that are
+// new, changed or unchanged compared to the cards stored in db, together with their
+// images if report has an image store.
+func compareCards(db *gorm.DB, attrList []CardAttrs, cardInfoList interface{}, report *DryRunReport) (SetChanges, error) {
+	var changes SetChanges
+	productIDs := make([]uint, len(attrList))
+	for i := range attrList {
+		productIDs[i] = uint(attrList[i].ProductID)
+	}
+	cardIDs, err := LookupCardIDs(db, productIDs)
+	if err != nil {
+		return changes, err
+	}
+	scraped := reflect.ValueOf(cardInfoList)
+	stored, err := loadCards(db, scraped.Type(), cardIDs)
+	if err != nil {
+		return changes, err
+	}
+
+	for i := 0; i < scraped.Len(); i++ {
+		cardID, mapped := cardIDs[productIDs[i]]
+		storedCard, found := stored[cardID]
+		switch {
+		case !mapped || !found:
+			changes.NewCards++
+		case cardChanged(storedCard, scraped.Index(i)):
+			changes.ChangedCards++
+		default:
+			changes.UnchangedCards++
+		}
+		if report.Store == nil {
+			continue
+		}
+		for _, variant := range ImageVariants {
+			if !mapped || !found {
+				changes.NewImages++
+				continue
+			}
+			mapping := ProductMapping{ProductID: productIDs[i], CardID: cardID}
+			switch report.imageChanged(db, variant, mapping) {
+			case nil:
+				changes.UnchangedImages++
+			case errImageMissing:
+				changes.NewImages++
+			default:
+				changes.ChangedImages++
+			}
+		}
+	}
+	return changes, nil
+}
+
+// loadCards returns the stored cards with the ids in cardIDs, keyed by id. listType is
+// the slice type of the card infos, e.g. []tcm.YuGiOhCardInfo.
+func loadCards(db *gorm.DB, listType reflect.Type, cardIDs map[uint]uint) (map[uint]reflect.Value, error) {
+	stored := make(map[uint]reflect.Value, len(cardIDs))
+	if len(cardIDs) == 0 {
+		return stored, nil
+	}
+	ids := make([]uint, 0, len(cardIDs))
+	for _, id := range cardIDs {
+		ids = append(ids, id)
+	}
+	list := reflect.New(listType)
+	tx := db.Where("id IN ?", ids).Find(list.Interface())
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for i := 0; i < list.Elem().Len(); i++ {
+		card := list.Elem().Index(i)
+		stored[uint(card.FieldByName("ID").Uint())] = card
+	}
+	return stored, nil
+}
+
+// cardChanged reports whether a scraped card differs from the stored one in any field
+// except its id and timestamps.
+func cardChanged(stored, scraped reflect.Value) bool {
+	for i := 0; i < stored.NumField(); i++ {
+		field := stored.Type().Field(i)
+		switch field.Name {
+		case "ID", "Model", "CreatedAt", "UpdatedAt", "DeletedAt":
+			continue
+		}
+		if field.PkgPath != "" {
+			continue // Unexported
+		}
+		if !reflect.DeepEqual(stored.Field(i).Interface(), scraped.Field(i).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageChanged checks the image variant of a stored card the way a scrape would fetch
+// it, see downloadImage, without downloading it. It returns nil if the image would be
+// left as it is, errImageMissing if it is not in the image manifest and another error
+// if it would be downloaded again.
+func (report *DryRunReport) imageChanged(db *gorm.DB, variant ImageVariant, mapping ProductMapping) error {
+	existing := findImageRecord(db, mapping.CardID, variant)
+	if existing == nil && SkipExistingImages && storedWithoutRecord(report.Store, variant, mapping) {
+		return nil
+	}
+	if existing == nil {
+		return errImageMissing
+	}
+	if problem := checkImageBlob(report.Store, *existing); problem != "" {
+		return fmt.Errorf("stored image: %s", problem)
+	}
+	if SkipExistingImages {
+		return nil
+	}
+	url := TcgpImageURL + "/" + variant.RemoteName(mapping.ProductID)
+	return revalidateImage(report.client, url, existing)
+}
+
+// revalidateImage sends a conditional HEAD request for the image at url with the
+// validators of cached. It returns nil if the image has not changed.
+func revalidateImage(client *http.Client, url string, cached *ImageRecord) error {
+	ImageRateLimiter.Wait()
+	request, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	if cached.ETag != "" {
+		request.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		request.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %q", response.Status)
+	}
+	if cached.ETag != "" && response.Header.Get("ETag") == cached.ETag {
+		return nil // The server ignored the validators
+	}
+	return errImageChanged
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// TEST: ReportCardInfo counts new, changed and unchanged cards and images without writing
+func TestDryRunReport(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	etag := `"v1"`
+	jpegData := testJPEG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", etag)
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+	defaultURL, defaultVariants := TcgpImageURL, ImageVariants
+	TcgpImageURL, ImageVariants = server.URL, []ImageVariant{"200w"}
+	defer func() { TcgpImageURL, ImageVariants = defaultURL, defaultVariants }()
+
+	setMap := map[string]tcm.SetInfo{"Set A": {ID: 1, Name: "Set A", ProductLineID: 1}}
+	stored := []tcm.YuGiOhCardInfo{
+		{ID: 1, Name: "Same", Rarity: "Common", SetID: 1, ProductLineID: 1},
+		{ID: 2, Name: "Reprinted", Rarity: "Common", SetID: 1, ProductLineID: 1},
+	}
+	if tx := db.Create(&stored); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	mappings := []ProductMapping{{ProductID: 101, CardID: 1, ProductLineID: 1, SetID: 1}, {ProductID: 102, CardID: 2, ProductLineID: 1, SetID: 1}}
+	if tx := writeProductMappings(db, mappings); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	record, err := downloadImage(server.Client(), store, "200w", mappings[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteImageRecord(db, record); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := []CardAttrs{
+		{ProductID: 101, ProductName: "Same", RarityName: "Common"},
+		{ProductID: 102, ProductName: "Reprinted", RarityName: "Rare"},
+		{ProductID: 103, ProductName: "New", RarityName: "Common"},
+	}
+	for i := range attrs {
+		attrs[i].ProductLineURLName, attrs[i].SetName = "YuGiOh", "Set A"
+	}
+	runReport := func() SetChanges {
+		report := NewDryRunReport(store)
+		var wg sync.WaitGroup
+		dataChan := make(chan []CardAttrs, 2)
+		wg.Add(1)
+		go ReportCardInfo(&wg, dataChan, db, setMap, report)
+		dataChan <- attrs
+		dataChan <- nil
+		wg.Wait()
+		var out bytes.Buffer
+		report.Print(&out)
+		if !strings.Contains(out.String(), "Set A") || !strings.Contains(out.String(), "TOTAL") {
+			t.Fatal("Expected a line for Set A and the totals  Got:", out.String())
+		}
+		return report.Changes("Set A")
+	}
+
+	expected := SetChanges{NewCards: 1, ChangedCards: 1, UnchangedCards: 1, NewImages: 2, UnchangedImages: 1}
+	if changes := runReport(); changes != expected {
+		t.Fatalf("Expected: %+v  Got: %+v", expected, changes)
+	}
+	etag = `"v2"`
+	expected.UnchangedImages, expected.ChangedImages = 0, 1
+	if changes := runReport(); changes != expected {
+		t.Fatalf("Expected a changed image: %+v  Got: %+v", expected, changes)
+	}
+
+	var count int64
+	db.Model(&tcm.YuGiOhCardInfo{}).Count(&count)
+	if count != 2 {
+		t.Fatal("Expected the dry run not to write cards  Got:", count)
+	}
+
+	// TEST: A scrape writes the new and changed cards the dry run reported, and only those
+	cards, err := tableName(db, &tcm.YuGiOhCardInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written int64
+	db.Callback().Create().After("gorm:create").Register("test:count_cards", func(tx *gorm.DB) {
+		if tx.Statement.Schema != nil && tx.Statement.Schema.Table == cards {
+			written += tx.RowsAffected
+		}
+	})
+	if err = NewDatabaseSink(db, setMap).Write(attrs); err != nil {
+		t.Fatal(err)
+	}
+	var reprinted tcm.YuGiOhCardInfo
+	db.First(&reprinted, 2)
+	db.Model(&tcm.YuGiOhCardInfo{}).Count(&count)
+	if written != 2 || count != 3 || reprinted.Rarity != "Rare" {
+		t.Fatal("Expected one inserted and one updated card  Got:", written, count, reprinted)
+	}
+}
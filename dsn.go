@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DataSourceName attributes hold informaition about a specific database.
+// The information is used to connect to said database.
+type DataSourceName struct {
+	Driver       string            `yaml:"driver"` // One of mysql, postgres or sqlite; defaults to mysql
+	Host         string            `yaml:"host"`
+	Port         string            `yaml:"port"`
+	User         string            `yaml:"user"`
+	Password     string            `yaml:"password"`
+	PasswordFile string            `yaml:"password_file"` // File holding the password, e.g. a Docker secret; overrides Password
+	Database     string            `yaml:"database"`      // Database name, or the database file path for sqlite
+	Charset      string            `yaml:"charset"`       // MySQL connection charset, e.g. utf8mb4
+	ParseTime    bool              `yaml:"parse_time"`    // MySQL: scan DATE and DATETIME columns into time.Time
+	Timezone     string            `yaml:"timezone"`      // Time zone of the session, e.g. UTC, Local or Europe/Berlin
+	TLS          TLSConfig         `yaml:"tls"`
+	Params       map[string]string `yaml:"params"` // Extra driver parameters, override the ones above
+}
+
+// TLSConfig holds the TLS settings of a database connection.
+type TLSConfig struct {
+	// Mode is one of disable, preferred, require (encrypt without verifying the
+	// server) or verify-full. It defaults to verify-full if CA is given, to require
+	// if only a client certificate is given and to the driver default otherwise.
+	Mode string `yaml:"mode"`
+	CA   string `yaml:"ca"`   // PEM file of the certificate authority of the server
+	Cert string `yaml:"cert"` // PEM file of the client certificate
+	Key  string `yaml:"key"`  // PEM file of the client key
+}
+
+// mysqlTLSConfigName is the name the custom TLS configuration of a MySQL connection
+// is registered under, see RegisterTLS.
+const mysqlTLSConfigName = "scraper"
+
+// charsetPattern matches a MySQL charset or a comma separated list of them.
+var charsetPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(,[A-Za-z0-9_]+)*$`)
+
+// DSNString returns a data source identifier string. The string is prefixed with the
+// scheme of the database driver, see ParseDSN. It holds the password in plain text;
+// use RedactDSN before logging it.
+func (dsn *DataSourceName) DSNString() string {
+	switch dsn.Driver {
+	case "sqlite":
+		return "sqlite://" + dsn.Database
+	case "postgres", "postgresql":
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(dsn.User, dsn.Password),
+			Host:     dsn.Host + ":" + dsn.Port,
+			Path:     "/" + dsn.Database,
+			RawQuery: dsn.params().Encode(),
+		}
+		return u.String()
+	default:
+		format := "mysql://%s:%s@tcp(%s:%s)/%s"
+		source := fmt.Sprintf(format, dsn.User, dsn.Password, dsn.Host, dsn.Port, dsn.Database)
+		if params := dsn.params(); len(params) > 0 {
+			source += "?" + params.Encode()
+		}
+		return source
+	}
+}
+
+// params returns the connection parameters of the data source in the form understood
+// by its driver.
+func (dsn *DataSourceName) params() url.Values {
+	params := url.Values{}
+	mode := dsn.TLS.mode()
+	switch dsn.Driver {
+	case "postgres", "postgresql":
+		if dsn.Timezone != "" {
+			params.Set("TimeZone", dsn.Timezone)
+		}
+		if mode == "preferred" {
+			mode = "prefer"
+		}
+		setNonEmpty(params, "sslmode", mode)
+		setNonEmpty(params, "sslrootcert", dsn.TLS.CA)
+		setNonEmpty(params, "sslcert", dsn.TLS.Cert)
+		setNonEmpty(params, "sslkey", dsn.TLS.Key)
+	default:
+		setNonEmpty(params, "charset", dsn.Charset)
+		if dsn.ParseTime {
+			params.Set("parseTime", "True")
+		}
+		setNonEmpty(params, "loc", dsn.Timezone)
+		switch {
+		case dsn.TLS.custom():
+			params.Set("tls", mysqlTLSConfigName)
+		case mode == "disable":
+			params.Set("tls", "false")
+		case mode == "preferred":
+			params.Set("tls", "preferred")
+		case mode == "require":
+			params.Set("tls", "skip-verify")
+		case mode == "verify-full":
+			params.Set("tls", "true")
+		}
+	}
+	for key, value := range dsn.Params {
+		params.Set(key, value)
+	}
+	return params
+}
+
+// setNonEmpty sets key to value unless value is empty.
+func setNonEmpty(params url.Values, key, value string) {
+	if value != "" {
+		params.Set(key, value)
+	}
+}
+
+// validateConnection returns a description of every invalid connection setting.
+func (dsn *DataSourceName) validateConnection() []string {
+	var problems []string
+	if _, ok := dialects[dsn.Driver]; dsn.Driver != "" && !ok {
+		problems = append(problems, fmt.Sprintf("database.driver: unsupported driver %q", dsn.Driver))
+	}
+	if dsn.Database == "" {
+		problems = append(problems, "database.database: no database name given")
+	}
+	if dsn.Driver != "sqlite" {
+		if dsn.Host == "" {
+			problems = append(problems, "database.host: no host given")
+		}
+		if _, err := strconv.ParseUint(dsn.Port, 10, 16); err != nil {
+			problems = append(problems, fmt.Sprintf("database.port: invalid port %q", dsn.Port))
+		}
+		if dsn.User == "" {
+			problems = append(problems, "database.user: no user given")
+		}
+	}
+	if dsn.Charset != "" && !charsetPattern.MatchString(dsn.Charset) {
+		problems = append(problems, fmt.Sprintf("database.charset: invalid charset %q", dsn.Charset))
+	}
+	if dsn.Timezone != "" {
+		if _, err := time.LoadLocation(dsn.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("database.timezone: %v", err))
+		}
+	}
+	for key := range dsn.Params {
+		if key == "" {
+			problems = append(problems, "database.params: empty parameter name")
+		}
+	}
+
+	tlsConfig := dsn.TLS
+	if tlsConfig == (TLSConfig{}) {
+		return problems
+	}
+	if dsn.Driver == "sqlite" {
+		return append(problems, "database.tls: not supported by sqlite")
+	}
+	switch tlsConfig.mode() {
+	case "disable", "preferred":
+		if tlsConfig.CA != "" || tlsConfig.Cert != "" || tlsConfig.Key != "" {
+			problems = append(problems, fmt.Sprintf("database.tls: ca, cert and key need mode require or verify-full, not %s", tlsConfig.Mode))
+		}
+	case "require", "verify-full":
+	default:
+		problems = append(problems, fmt.Sprintf("database.tls.mode: unknown mode %q, expected disable, preferred, require or verify-full", tlsConfig.Mode))
+	}
+	if (tlsConfig.Cert == "") != (tlsConfig.Key == "") {
+		problems = append(problems, "database.tls: cert and key must be given together")
+	} else if _, err := tlsConfig.Config(dsn.Host); err != nil {
+		problems = append(problems, "database.tls: "+err.Error())
+	}
+	return problems
+}
+
+// RegisterTLS registers the custom TLS configuration of a MySQL data source with the
+// MySQL driver. It does nothing for other data sources or if the driver's built-in
+// TLS modes suffice.
+func (dsn *DataSourceName) RegisterTLS() error {
+	if (dsn.Driver != "" && dsn.Driver != "mysql") || !dsn.TLS.custom() {
+		return nil
+	}
+	tlsConfig, err := dsn.TLS.Config(dsn.Host)
+	if err != nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConfig)
+}
+
+// mode returns the effective TLS mode, see TLSConfig.
+func (t TLSConfig) mode() string {
+	switch {
+	case t.Mode != "":
+		return t.Mode
+	case t.CA != "":
+		return "verify-full"
+	case t.Cert != "":
+		return "require"
+	}
+	return ""
+}
+
+// custom reports whether the TLS settings need certificates beyond the system ones.
+func (t TLSConfig) custom() bool {
+	return t.CA != "" || t.Cert != ""
+}
+
+// Config returns the TLS configuration for connections to serverName. The CA and
+// client certificate files are read and parsed.
+func (t TLSConfig) Config(serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: t.mode() != "verify-full",
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// ExportEntities lists the entities that can be exported one file each, in the order
+// they are exported.
+var ExportEntities = []string{"product_lines", "sets", "cards", "prices", "images"}
+
+// CatalogEntity is the denormalized export: one row per card with its set, product
+// line, tcgplayer product id, latest price and the paths of its ImageVariants.
+const CatalogEntity = "catalog"
+
+// ExportFormats lists the file formats of Export.
+var ExportFormats = []string{"csv", "jsonl"}
+
+// cardColumns are the exported columns of the card table, see makeCardInfoList.
+var cardColumns = []string{
+	"id", "name", "number", "rarity", "set_id", "product_line_id", "card_type", "attribute", "level", "attack", "defense",
+	"url_name", "card_type_b", "monster_type", "link_arrows", "description",
+}
+
+// ExportFilter selects the rows to export.
+type ExportFilter struct {
+	ProductLineID uint   // Zero for all product lines
+	SetIDs        []uint // Nil for all sets
+}
+
+// productLines returns a query of the product lines selected by the filter.
+func (filter ExportFilter) productLines(db *gorm.DB) *gorm.DB {
+	query := db.Model(&tcm.ProductLine{})
+	if filter.ProductLineID != 0 {
+		query = query.Where("id = ?", filter.ProductLineID)
+	}
+	return query
+}
+
+// sets returns a query of the sets selected by the filter.
+func (filter ExportFilter) sets(db *gorm.DB) *gorm.DB {
+	query := db.Model(&tcm.SetInfo{})
+	if filter.ProductLineID != 0 {
+		query = query.Where("product_line_id = ?", filter.ProductLineID)
+	}
+	if filter.SetIDs != nil {
+		query = query.Where("id IN ?", filter.SetIDs)
+	}
+	return query
+}
+
+// cards returns a query of the cards selected by the filter.
+func (filter ExportFilter) cards(db *gorm.DB) *gorm.DB {
+	query := db.Model(&tcm.YuGiOhCardInfo{})
+	if filter.ProductLineID != 0 {
+		query = query.Where("product_line_id = ?", filter.ProductLineID)
+	}
+	if filter.SetIDs != nil {
+		query = query.Where("set_id IN ?", filter.SetIDs)
+	}
+	return query
+}
+
+// ExportCardsCSV writes the cards of a product line as CSV to w, one row per card
+// with a header row first. All product lines are exported if productLineID is zero.
+func ExportCardsCSV(db *gorm.DB, w io.Writer, productLineID uint) error {
+	_, err := Export(db, w, "csv", "cards", ExportFilter{ProductLineID: productLineID})
+	return err
+}
+
+// Export writes the rows of entity, one of ExportEntities or CatalogEntity, selected by
+// filter to w in format, one of ExportFormats, and returns the number of rows written.
+// Rows are streamed from the database, so the export does not hold the whole table in
+// memory.
+func Export(db *gorm.DB, w io.Writer, format, entity string, filter ExportFilter) (int64, error) {
+	out, err := NewRowWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+	query, err := exportQuery(db, entity, filter)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]string, len(columnTypes))
+	numeric := make([]bool, len(columnTypes))
+	for i, columnType := range columnTypes {
+		columns[i] = columnType.Name()
+		numeric[i] = numericColumn(columnType)
+	}
+	err = out.WriteHeader(columns)
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	var count int64
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return count, err
+		}
+		for i, value := range values {
+			if b, ok := value.([]byte); ok && numeric[i] {
+				values[i] = json.Number(b) // Numbers scanned as text, e.g. by the MySQL driver
+			}
+		}
+		err = out.WriteRow(values)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// numericColumn reports whether a column holds numbers.
+func numericColumn(columnType *sql.ColumnType) bool {
+	name := strings.ToUpper(columnType.DatabaseTypeName())
+	for _, kind := range []string{"INT", "DEC", "NUM", "FLOAT", "DOUBLE", "REAL"} {
+		if strings.Contains(name, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportQuery returns the query selecting the rows of an exported entity, ordered by id.
+func exportQuery(db *gorm.DB, entity string, filter ExportFilter) (*gorm.DB, error) {
+	switch entity {
+	case "product_lines":
+		return filter.productLines(db).Order("id"), nil
+	case "sets":
+		return filter.sets(db).Order("id"), nil
+	case "cards":
+		return filter.cards(db).Select(cardColumns).Order("id"), nil
+	case "prices":
+		return db.Model(&CardPrice{}).Where("card_id IN (?)", filter.cards(db).Select("id")).Order("id"), nil
+	case "images":
+		return db.Model(&ImageRecord{}).
+			Select("card_id", "product_id", "variant", "path", "size", "sha256", "width", "height", "fetched_at").
+			Where("card_id IN (?)", filter.cards(db).Select("id")).Order("id"), nil
+	case CatalogEntity:
+		return catalogQuery(db, filter)
+	}
+	return nil, fmt.Errorf("unknown export entity %q, expected one of %s or %s", entity, strings.Join(ExportEntities, ", "), CatalogEntity)
+}
+
+// catalogQuery returns the query of the CatalogEntity export.
+func catalogQuery(db *gorm.DB, filter ExportFilter) (*gorm.DB, error) {
+	tables := make(map[string]string)
+	for name, model := range map[string]interface{}{"cards": &tcm.YuGiOhCardInfo{}, "sets": &tcm.SetInfo{}, "product_lines": &tcm.ProductLine{}} {
+		table, err := tableName(db, model)
+		if err != nil {
+			return nil, err
+		}
+		tables[name] = table
+	}
+
+	var columns []string
+	for _, column := range cardColumns {
+		if column != "set_id" && column != "product_line_id" {
+			columns = append(columns, "c."+column)
+		}
+	}
+	columns = append(columns,
+		"pm.product_id",
+		"s.id AS set_id", "s.name AS set_name", "s.url_name AS set_url_name",
+		"pl.id AS product_line_id", "pl.name AS product_line_name",
+	)
+	latestPrice := "(SELECT p.%s FROM card_prices p WHERE p.card_id = c.id ORDER BY p.fetched_at DESC, p.id DESC LIMIT 1) AS %s"
+	for _, column := range []string{"market_price", "lowest_price", "lowest_price_with_shipping", "fetched_at"} {
+		alias := column
+		if column == "fetched_at" {
+			alias = "price_fetched_at"
+		}
+		columns = append(columns, fmt.Sprintf(latestPrice, column, alias))
+	}
+	var args []interface{}
+	for _, variant := range ImageVariants {
+		columns = append(columns, "(SELECT i.path FROM images i WHERE i.card_id = c.id AND i.variant = ?) AS image_"+string(variant))
+		args = append(args, string(variant))
+	}
+
+	query := db.Table(tables["cards"]+" AS c").
+		Select(strings.Join(columns, ", "), args...).
+		Joins("LEFT JOIN product_mappings pm ON pm.card_id = c.id").
+		Joins("JOIN " + tables["sets"] + " s ON s.id = c.set_id").
+		Joins("JOIN " + tables["product_lines"] + " pl ON pl.id = c.product_line_id")
+	if filter.ProductLineID != 0 {
+		query = query.Where("c.product_line_id = ?", filter.ProductLineID)
+	}
+	if filter.SetIDs != nil {
+		query = query.Where("c.set_id IN ?", filter.SetIDs)
+	}
+	return query.Order("c.id"), nil
+}
+
+// ExportSetIDs returns the ids of the stored sets of a product line that pass filter,
+// or nil if filter selects every set. Sets of all product lines are selected if
+// productLineID is zero.
+func ExportSetIDs(db *gorm.DB, productLineID uint, filter *SetFilter) ([]uint, error) {
+	if filter.IsZero() {
+		return nil, nil
+	}
+	var productLines []tcm.ProductLine
+	query := db.Order("id")
+	if productLineID != 0 {
+		query = query.Where("id = ?", productLineID)
+	}
+	if tx := query.Find(&productLines); tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	ids := []uint{}
+	for _, productLine := range productLines {
+		var setInfos []tcm.SetInfo
+		if tx := db.Where("product_line_id = ?", productLine.ID).Order("id").Find(&setInfos); tx.Error != nil {
+			return nil, tx.Error
+		}
+		firstSeen, err := FirstSeenSets(db, productLine.Name)
+		if err != nil {
+			return nil, err
+		}
+		sets := make([]itemInfo, len(setInfos))
+		byURLName := make(map[string]uint, len(setInfos))
+		for i, elem := range setInfos {
+			sets[i] = itemInfo{Value: elem.Name, URLValue: elem.URLName, Count: float32(elem.CardCount)}
+			byURLName[elem.URLName] = elem.ID
+		}
+		for _, set := range filter.Select(sets, firstSeen) {
+			ids = append(ids, byURLName[set.URLValue])
+		}
+	}
+	return ids, nil
+}
+
+// RowWriter writes exported rows in a file format.
+type RowWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []interface{}) error
+	Flush() error
+}
+
+// NewRowWriter returns a RowWriter writing format, one of ExportFormats, to w.
+func NewRowWriter(format string, w io.Writer) (RowWriter, error) {
+	switch format {
+	case "csv":
+		return &csvRowWriter{out: csv.NewWriter(w)}, nil
+	case "jsonl":
+		return &jsonlRowWriter{out: bufio.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+}
+
+// csvRowWriter writes a header row followed by one row per record.
+type csvRowWriter struct {
+	out    *csv.Writer
+	record []string
+	rows   int
+}
+
+func (cw *csvRowWriter) WriteHeader(columns []string) error {
+	cw.record = make([]string, len(columns))
+	return cw.out.Write(columns)
+}
+
+func (cw *csvRowWriter) WriteRow(values []interface{}) error {
+	for i, value := range values {
+		cw.record[i] = formatCSVValue(value)
+	}
+	err := cw.out.Write(cw.record)
+	if err != nil {
+		return err
+	}
+	cw.rows++
+	if cw.rows%InsertBatchSize == 0 {
+		cw.out.Flush()
+		return cw.out.Error()
+	}
+	return nil
+}
+
+func (cw *csvRowWriter) Flush() error {
+	cw.out.Flush()
+	return cw.out.Error()
+}
+
+// formatCSVValue formats a value scanned from the database for a CSV field.
+func formatCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+// jsonlRowWriter writes one JSON object per row, with the columns as keys in their
+// original order.
+type jsonlRowWriter struct {
+	out     *bufio.Writer
+	columns [][]byte // JSON encoded column names
+}
+
+func (jw *jsonlRowWriter) WriteHeader(columns []string) error {
+	jw.columns = make([][]byte, len(columns))
+	for i, column := range columns {
+		jw.columns[i], _ = json.Marshal(column)
+	}
+	return nil
+}
+
+func (jw *jsonlRowWriter) WriteRow(values []interface{}) error {
+	jw.out.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			jw.out.WriteByte(',')
+		}
+		jw.out.Write(jw.columns[i])
+		jw.out.WriteByte(':')
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		jw.out.Write(data)
+	}
+	_, err := jw.out.WriteString("}\n")
+	return err
+}
+
+func (jw *jsonlRowWriter) Flush() error {
+	return jw.out.Flush()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm/logger"
+)
+
+// TEST: ExportCardsCSV writes the cards of one product line
+func TestExportCardsCSV(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	seedProductLine(t, db, "YuGiOh", 3)
+	seedProductLine(t, db, "Magic", 2)
+	productLineID, err := GetProductLineID(db, "Magic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	err = ExportCardsCSV(db, &out, productLineID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "id" || rows[1][1] != "Magic Card 0" {
+		t.Fatal("Expected a header and 2 Magic cards  Got:", rows)
+	}
+}
+
+// TEST: Export writes every entity as JSON Lines and a denormalized catalog as CSV
+func TestExport(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	seedProductLine(t, db, "YuGiOh", 3)
+	magic := seedProductLine(t, db, "Magic", 2)
+	productLineID, err := GetProductLineID(db, "Magic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	prices := []CardPrice{
+		{CardID: magic[0].ID, ProductID: magic[0].ID + 1000, MarketPrice: 1.5, FetchedAt: fetched},
+		{CardID: magic[0].ID, ProductID: magic[0].ID + 1000, MarketPrice: 2.25, FetchedAt: fetched.Add(time.Hour)},
+	}
+	if tx := db.Create(&prices); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	image := ImageRecord{CardID: magic[0].ID, ProductID: magic[0].ID + 1000, Variant: "200w", Path: "7_200w.jpg", FetchedAt: fetched}
+	if err = WriteImageRecord(db, &image); err != nil {
+		t.Fatal(err)
+	}
+	filter := ExportFilter{ProductLineID: productLineID}
+
+	expected := map[string]int64{"product_lines": 1, "sets": 1, "cards": 2, "prices": 2, "images": 1}
+	for _, entity := range ExportEntities {
+		var out strings.Builder
+		count, err := Export(db, &out, "jsonl", entity, filter)
+		if err != nil {
+			t.Fatal(entity, err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if count != expected[entity] || len(lines) != int(count) {
+			t.Fatal("Expected", expected[entity], entity, " Got:", out.String())
+		}
+		var row map[string]interface{}
+		if err = json.Unmarshal([]byte(lines[0]), &row); err != nil {
+			t.Fatal(entity, err)
+		}
+	}
+	var out strings.Builder
+	Export(db, &out, "jsonl", "cards", filter)
+	if !strings.HasPrefix(out.String(), `{"id":`) || !strings.Contains(out.String(), `"name":"Magic Card 0"`) {
+		t.Fatal("Expected ordered JSON objects with typed values  Got:", out.String())
+	}
+
+	defaultVariants := ImageVariants
+	ImageVariants = []ImageVariant{"200w"}
+	defer func() { ImageVariants = defaultVariants }()
+	out.Reset()
+	if _, err = Export(db, &out, "csv", CatalogEntity, filter); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal("Expected a header and 2 catalog rows  Got:", records)
+	}
+	row := make(map[string]string)
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+	if row["set_name"] != "Magic Set" || row["product_line_name"] != "Magic" || row["market_price"] != "2.25" || row["image_200w"] != "7_200w.jpg" {
+		t.Fatal("Expected the set, product line, latest price and image of the card  Got:", row)
+	}
+
+	setIDs, err := ExportSetIDs(db, 0, &SetFilter{Include: []SetPattern{{glob: "yugioh-*"}}})
+	if err != nil || len(setIDs) != 1 {
+		t.Fatal("Expected the YuGiOh set  Got:", setIDs, err)
+	}
+	count, err := Export(db, ioutil.Discard, "csv", "cards", ExportFilter{SetIDs: setIDs})
+	if err != nil || count != 3 {
+		t.Fatal("Expected the 3 YuGiOh cards  Got:", count, err)
+	}
+	if _, err = Export(db, ioutil.Discard, "xml", "cards", filter); err == nil {
+		t.Fatal("Expected an error for an unknown format")
+	}
+}
+
+// TEST: ExportSQLite copies the selected rows into a SQLite file with a full-text index
+func TestExportSQLite(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	seedProductLine(t, db, "YuGiOh", 3)
+	magic := seedProductLine(t, db, "Magic", 2)
+	db.Create(&CardPrice{CardID: magic[1].ID, ProductID: magic[1].ID + 1000, MarketPrice: 3, FetchedAt: time.Now()})
+	productLineID, err := GetProductLineID(db, "Magic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "catalog.db")
+
+	fullText := hasFTS5(db)
+	counts, err := ExportSQLite(db, path, ExportFilter{ProductLineID: productLineID}, fullText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["product_lines"] != 1 || counts["sets"] != 1 || counts["cards"] != 2 || counts["product_mappings"] != 2 || counts["prices"] != 1 {
+		t.Fatal("Expected the rows of the Magic product line  Got:", counts)
+	}
+	snapshot := GetDBConnection("sqlite://"+path, logger.Silent)
+	var names []string
+	snapshot.Model(&tcm.YuGiOhCardInfo{}).Order("id").Pluck("name", &names)
+	if len(names) != 2 || names[1] != "Magic Card 1" {
+		t.Fatal("Expected the Magic cards in the snapshot  Got:", names)
+	}
+	if !fullText {
+		t.Log("SQLite was built without FTS5, run the tests with -tags sqlite_fts5 to test the full-text index")
+		if _, err = ExportSQLite(db, path, ExportFilter{}, true); err != errNoFTS5 {
+			t.Fatal("Expected errNoFTS5  Got:", err)
+		}
+		return
+	}
+	var ids []uint
+	snapshot.Raw("SELECT rowid FROM "+CardSearchTable+" WHERE "+CardSearchTable+" MATCH ?", `"card 1"`).Scan(&ids)
+	if len(ids) != 1 || ids[0] != magic[1].ID {
+		t.Fatal("Expected the full-text index to find Magic Card 1  Got:", ids)
+	}
+}
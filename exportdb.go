@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// CardSearchTable is the FTS5 full-text index on the names and descriptions of the
+// cards of an ExportSQLite snapshot. Its rowid is the card id, e.g.
+//
+//	SELECT rowid FROM card_search WHERE card_search MATCH 'blue eyes'
+const CardSearchTable = "card_search"
+
+// errNoFTS5 is returned by ExportSQLite if a full-text index is requested from a build
+// without FTS5 support.
+var errNoFTS5 = errors.New("this build of SQLite has no FTS5 support, rebuild with -tags sqlite_fts5")
+
+// ExportSQLite copies the product lines, sets, cards, product mappings and prices
+// selected by filter into a new SQLite database file at path, and returns the number
+// of rows copied per table. Rows are copied in batches of InsertBatchSize. If fullText
+// is set, the card names and descriptions are indexed in CardSearchTable. The file is
+// written under a temporary name and renamed to path when it is complete.
+func ExportSQLite(db *gorm.DB, path string, filter ExportFilter, fullText bool) (map[string]int64, error) {
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	out, err := gorm.Open(sqlite.Open(tmpPath), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+	counts, err := exportSQLite(db, out, filter, fullText)
+	if sqlDB, dbErr := out.DB(); dbErr == nil {
+		sqlDB.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return counts, os.Rename(tmpPath, path)
+}
+
+// exportSQLite creates the snapshot schema in out and copies the rows, see ExportSQLite.
+func exportSQLite(db, out *gorm.DB, filter ExportFilter, fullText bool) (map[string]int64, error) {
+	if fullText && !hasFTS5(out) {
+		return nil, errNoFTS5
+	}
+	err := out.AutoMigrate(&tcm.ProductLine{}, &tcm.SetInfo{}, &tcm.YuGiOhCardInfo{}, &ProductMapping{}, &CardPrice{})
+	if err != nil {
+		return nil, err
+	}
+
+	cardIDs := filter.cards(db).Select("id")
+	copies := []struct {
+		name  string
+		query *gorm.DB
+		rows  interface{}
+	}{
+		{"product_lines", filter.productLines(db), &[]tcm.ProductLine{}},
+		{"sets", filter.sets(db), &[]tcm.SetInfo{}},
+		{"cards", filter.cards(db), &[]tcm.YuGiOhCardInfo{}},
+		{"product_mappings", db.Model(&ProductMapping{}).Where("card_id IN (?)", cardIDs), &[]ProductMapping{}},
+		{"prices", db.Model(&CardPrice{}).Where("card_id IN (?)", cardIDs), &[]CardPrice{}},
+	}
+	counts := make(map[string]int64)
+	for _, c := range copies {
+		count, err := copyRows(c.query, out, c.rows)
+		if err != nil {
+			return nil, fmt.Errorf("copying %s: %v", c.name, err)
+		}
+		counts[c.name] = count
+	}
+
+	cards, err := tableName(out, &tcm.YuGiOhCardInfo{})
+	if err != nil {
+		return nil, err
+	}
+	sets, err := tableName(out, &tcm.SetInfo{})
+	if err != nil {
+		return nil, err
+	}
+	statements := []string{
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_name ON %s (name)", cards, cards),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_set_id ON %s (set_id)", cards, cards),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_product_line_id ON %s (product_line_id)", cards, cards),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_product_line_id ON %s (product_line_id)", sets, sets),
+	}
+	if fullText {
+		statements = append(statements,
+			fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(name, description, content='%s', content_rowid='id')", CardSearchTable, cards),
+			fmt.Sprintf("INSERT INTO %s(%s) VALUES('rebuild')", CardSearchTable, CardSearchTable),
+		)
+	}
+	statements = append(statements, "ANALYZE")
+	for _, statement := range statements {
+		if tx := out.Exec(statement); tx.Error != nil {
+			return nil, tx.Error
+		}
+	}
+	return counts, nil
+}
+
+// copyRows copies the rows selected by query into the same table of out, in batches of
+// InsertBatchSize. rows is a pointer to an empty slice of the model of query.
+func copyRows(query, out *gorm.DB, rows interface{}) (int64, error) {
+	var count int64
+	tx := query.FindInBatches(rows, InsertBatchSize, func(tx *gorm.DB, batch int) error {
+		count += tx.RowsAffected
+		return out.Create(rows).Error
+	})
+	return count, tx.Error
+}
+
+// tableName returns the name of the table of model.
+func tableName(db *gorm.DB, model interface{}) (string, error) {
+	stmt := &gorm.Statement{DB: db}
+	err := stmt.Parse(model)
+	if err != nil {
+		return "", err
+	}
+	return stmt.Schema.Table, nil
+}
+
+// hasFTS5 reports whether the SQLite library of db supports FTS5 tables.
+func hasFTS5(db *gorm.DB) bool {
+	var enabled int
+	tx := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	return tx.Error == nil && enabled == 1
+}
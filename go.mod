@@ -3,8 +3,13 @@ module github.com/gurbos/scraper
 go 1.15
 
 require (
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/gurbos/tcmodels v1.4.3-beta
 	github.com/joho/godotenv v1.3.0
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/driver/mysql v1.1.1
+	gorm.io/driver/postgres v1.1.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.11
 )
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ImageVariants lists the image sizes downloaded for every card, see ImageVariant.
+var ImageVariants = []ImageVariant{"200w"}
+
+// ImageAttempts is the number of times an image download is attempted before it is
+// recorded as a failure.
+var ImageAttempts int = 3
+
+// ImageRetryDelay is the time waited before the second attempt of an image download.
+// The delay grows linearly with every further attempt.
+var ImageRetryDelay = 2 * time.Second
+
+// ImageBatchSize is the number of product mappings read from the database and handed to
+// a GetImages goroutine at a time.
+var ImageBatchSize int = 100
+
+// SkipExistingImages makes GetImages skip images that are in the image manifest and
+// whose stored blob has the recorded size, so an interrupted image pass can be resumed
+// cheaply. Images without a manifest record are skipped if a non-empty blob is stored
+// under their local name, which covers stores filled before the manifest existed but
+// not content-addressed stores.
+var SkipExistingImages bool
+
+// errImageMissing is returned when the CDN has no image for the requested variant.
+var errImageMissing = errors.New("image not found")
+
+// errImageNotModified is returned when the CDN answers a conditional request with 304.
+var errImageNotModified = errors.New("image not modified")
+
+// ImageFailure describes an image variant that could not be downloaded.
+type ImageFailure struct {
+	CardID    uint
+	ProductID uint
+	Variant   ImageVariant
+	Err       error
+}
+
+// ImageFailureLog collects the failures reported by concurrent GetImages goroutines.
+type ImageFailureLog struct {
+	mu       sync.Mutex
+	failures []ImageFailure
+}
+
+// Add records a failure.
+func (fl *ImageFailureLog) Add(failure ImageFailure) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.failures = append(fl.failures, failure)
+}
+
+// Failures returns the recorded failures.
+func (fl *ImageFailureLog) Failures() []ImageFailure {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return append([]ImageFailure(nil), fl.failures...)
+}
+
+// Report writes one line per recorded failure to w.
+func (fl *ImageFailureLog) Report(w io.Writer) {
+	failures := fl.Failures()
+	fmt.Fprintf(w, "Failed images: %d\n", len(failures))
+	for _, elem := range failures {
+		fmt.Fprintf(w, "  card %d  product %d  %-8s %v\n", elem.CardID, elem.ProductID, elem.Variant, elem.Err)
+	}
+}
+
+// variantPattern matches image widths such as 200w or 400w.
+var variantPattern = regexp.MustCompile(`^[1-9][0-9]*w$`)
+
+// ImageVariant identifies one of the image sizes offered by the tcgplayer CDN. A
+// variant is either a width such as 200w, or "original" for the full size art.
+type ImageVariant string
+
+// ParseImageVariants parses a comma separated list of image variants.
+func ParseImageVariants(list string) ([]ImageVariant, error) {
+	var variants []ImageVariant
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		if elem != "original" && !variantPattern.MatchString(elem) {
+			return nil, fmt.Errorf("invalid image variant %q, expected a width such as 200w or \"original\"", elem)
+		}
+		variants = append(variants, ImageVariant(elem))
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("no image variants given")
+	}
+	return variants, nil
+}
+
+// RemoteName returns the CDN file name of the variant of the given product's image.
+func (v ImageVariant) RemoteName(productID uint) string {
+	if v == "original" {
+		return strconv.Itoa(int(productID)) + "_in_1000x1000.jpg"
+	}
+	return strconv.Itoa(int(productID)) + "_" + string(v) + ".jpg"
+}
+
+// LocalName returns the file name under which the variant of a card's image is stored.
+// Card image files are named using the corresponding card id number and the variant.
+func (v ImageVariant) LocalName(cardID uint) string {
+	return strconv.Itoa(int(cardID)) + "_" + string(v) + ".jpg"
+}
+
+// StreamProductMappings sends the product mappings selected by query to dataChan in batches
+// of ImageBatchSize, ordered by card id. Batches are read with keyset pagination on card_id,
+// so every query uses the index no matter how far the scan has progressed.
+func StreamProductMappings(query *gorm.DB, dataChan chan []ProductMapping) error {
+	var lastCardID uint
+	for {
+		var batch []ProductMapping
+		tx := query.Session(&gorm.Session{}).Where("card_id > ?", lastCardID).Order("card_id ASC").Limit(ImageBatchSize).Find(&batch)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		dataChan <- batch
+		lastCardID = batch[len(batch)-1].CardID
+		if len(batch) < ImageBatchSize {
+			return nil
+		}
+	}
+}
+
+// ImageSelection selects the cards whose images are fetched by FetchImages.
+type ImageSelection struct {
+	ProductLineID uint   // Zero selects all product lines
+	SetID         uint   // Zero selects all sets
+	CardIDs       []uint // Empty selects all cards
+	MissingOnly   bool   // Only select cards with a variant in ImageVariants missing from the manifest
+}
+
+// Query returns a query for the product mappings of the selected cards.
+func (sel ImageSelection) Query(db *gorm.DB) *gorm.DB {
+	query := db.Model(&ProductMapping{})
+	if sel.ProductLineID != 0 {
+		query = query.Where("product_line_id = ?", sel.ProductLineID)
+	}
+	if sel.SetID != 0 {
+		query = query.Where("set_id = ?", sel.SetID)
+	}
+	if len(sel.CardIDs) > 0 {
+		query = query.Where("card_id IN ?", sel.CardIDs)
+	}
+	if sel.MissingOnly {
+		variants := make([]string, len(ImageVariants))
+		for i, variant := range ImageVariants {
+			variants[i] = string(variant)
+		}
+		query = query.Where(
+			"(SELECT COUNT(*) FROM images WHERE images.card_id = product_mappings.card_id AND images.variant IN ?) < ?",
+			variants, len(variants),
+		)
+	}
+	return query
+}
+
+// FetchImages downloads the card images of the product mappings selected by query into
+// store, using the given number of GetImages goroutines. Progress is written to w. The
+// returned log holds the images that could not be downloaded.
+func FetchImages(db *gorm.DB, store BlobStore, query *gorm.DB, workers int, w io.Writer) (*ImageFailureLog, error) {
+	var total int64
+	tx := query.Session(&gorm.Session{}).Count(&total)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var wg sync.WaitGroup
+	var failures ImageFailureLog
+	dataChan := make(chan []ProductMapping, workers*2) // Buffered channel used to pass lists of ProductMapping objects
+	progress := NewImageProgress(w, total)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go GetImages(&wg, dataChan, store, db, &failures, progress)
+	}
+	err := StreamProductMappings(query, dataChan)
+	TerminateCardImageGoroutines(&wg, dataChan, workers)
+	return &failures, err
+}
+
+// ImageProgress counts the cards whose images GetImages goroutines have finished and
+// writes the percentage of the total to w, one line per whole percent. It is safe for
+// concurrent use.
+type ImageProgress struct {
+	w           io.Writer
+	total       int64
+	done        int64 // Accessed atomically
+	mu          sync.Mutex
+	lastPercent int64
+}
+
+// NewImageProgress returns an ImageProgress for total cards.
+func NewImageProgress(w io.Writer, total int64) *ImageProgress {
+	return &ImageProgress{w: w, total: total, lastPercent: -1}
+}
+
+// Add counts n more finished cards.
+func (p *ImageProgress) Add(n int64) {
+	done := atomic.AddInt64(&p.done, n)
+	if p.total <= 0 {
+		return
+	}
+	percent := done * 100 / p.total
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if percent <= p.lastPercent {
+		return
+	}
+	p.lastPercent = percent
+	fmt.Fprintf(p.w, "Images: %3d%% (%d of %d cards)\n", percent, done, p.total)
+}
+
+// GetImages is meant to be executed as a goroutine. It receives lists of product mappings
+// through dataChan and downloads every variant in ImageVariants of the corresponding card
+// images into store. Variants that cannot be downloaded are added to failures and do not
+// stop the others. Downloaded images are recorded in the image manifest of db, unless db
+// is nil. Every finished card is counted in progress, unless progress is nil.
+func GetImages(wg *sync.WaitGroup, dataChan chan []ProductMapping, store BlobStore, db *gorm.DB, failures *ImageFailureLog, progress *ImageProgress) {
+	defer wg.Done()
+
+	client := http.Client{Timeout: time.Duration(DefaultTimeout) * time.Second}
+	for true {
+		data := <-dataChan
+		if data == nil {
+			break
+		}
+		for i := 0; i < len(data); i++ {
+			for _, variant := range ImageVariants {
+				err := getImage(&client, store, db, variant, data[i])
+				if err != nil {
+					failures.Add(ImageFailure{CardID: data[i].CardID, ProductID: data[i].ProductID, Variant: variant, Err: err})
+				}
+			}
+			if progress != nil {
+				progress.Add(1)
+			}
+		}
+	}
+}
+
+// getImage downloads a card image variant, generates its ImageDerivatives and records
+// both in the image manifest of db, unless db is nil. Derivatives of an image that has
+// not changed are only generated if they are missing from the manifest.
+func getImage(client *http.Client, store BlobStore, db *gorm.DB, variant ImageVariant, mapping ProductMapping) error {
+	var existing *ImageRecord
+	if db != nil {
+		existing = findImageRecord(db, mapping.CardID, variant)
+	}
+	record, err := downloadImage(client, store, variant, mapping, existing)
+	if err != nil {
+		return err
+	}
+	if record != nil && db != nil {
+		err = WriteImageRecord(db, record)
+		if err != nil {
+			return err
+		}
+	}
+	if len(ImageDerivatives) == 0 {
+		return nil
+	}
+
+	source, derivatives := record, ImageDerivatives
+	if source == nil && existing == nil {
+		return nil // Skipped without a manifest record, see SkipExistingImages
+	}
+	if source == nil {
+		source, derivatives = existing, nil
+		for _, derivative := range ImageDerivatives {
+			if findImageRecord(db, mapping.CardID, derivative.Variant(variant)) == nil {
+				derivatives = append(derivatives, derivative)
+			}
+		}
+	}
+	records, err := deriveImages(store, *source, derivatives)
+	for i := 0; i < len(records) && db != nil; i++ {
+		writeErr := WriteImageRecord(db, &records[i])
+		if err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// storedWithoutRecord reports whether a non-empty blob is stored under the local name of
+// the image variant, see SkipExistingImages.
+func storedWithoutRecord(store BlobStore, variant ImageVariant, mapping ProductMapping) bool {
+	size, err := store.Size(variant.LocalName(mapping.CardID))
+	return err == nil && size > 0
+}
+
+// downloadImage downloads a single image variant and writes it to store. Invalid
+// responses are retried up to ImageAttempts times; missing images are not retried.
+// If the blob described by the existing manifest record exists with the recorded size,
+// see checkImageBlob, it is skipped without a request when SkipExistingImages is set,
+// and revalidated with a conditional request otherwise. A nil record is returned for
+// images that were not rewritten, else the returned record describes the stored blob.
+func downloadImage(client *http.Client, store BlobStore, variant ImageVariant, mapping ProductMapping, existing *ImageRecord) (*ImageRecord, error) {
+	if existing == nil && SkipExistingImages && storedWithoutRecord(store, variant, mapping) {
+		return nil, nil
+	}
+	var cached *ImageRecord // Manifest record whose validators are sent with the request
+	if existing != nil && checkImageBlob(store, *existing) == "" {
+		if SkipExistingImages {
+			return nil, nil
+		}
+		cached = existing
+	}
+	url := TcgpImageURL + "/" + variant.RemoteName(mapping.ProductID) // Build filename url from resource domain and remote filename
+
+	var img *fetchedImage
+	var err error
+	for attempt := 1; attempt <= ImageAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * ImageRetryDelay)
+		}
+		img, err = fetchImage(client, url, cached)
+		if err == nil || err == errImageMissing || err == errImageNotModified {
+			break
+		}
+	}
+	if err == errImageNotModified {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := store.Put(variant.LocalName(mapping.CardID), img.Data)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(img.Data)
+	record := ImageRecord{
+		CardID:       mapping.CardID,
+		ProductID:    mapping.ProductID,
+		Variant:      string(variant),
+		Path:         location,
+		Size:         int64(len(img.Data)),
+		SHA256:       hex.EncodeToString(sum[:]),
+		Width:        img.Width,
+		Height:       img.Height,
+		FetchedAt:    time.Now(),
+		ETag:         img.ETag,
+		LastModified: img.LastModified,
+	}
+	return &record, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path and renames
+// it to path once the data is on disk. Readers never see a partially written file, and
+// a crash leaves at most a stray temporary file behind.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// fetchedImage holds the body of a validated image response.
+type fetchedImage struct {
+	Data   []byte
+	Width  int // Width in pixels
+	Height int // Height in pixels
+
+	ETag         string
+	LastModified string
+}
+
+// fetchImage requests url and returns the response body. The body is only returned if
+// the response has a 2xx status, an image content type and decodes as a JPEG image.
+// If cached is not nil, its validators are sent as If-None-Match and If-Modified-Since
+// headers, and errImageNotModified is returned when the server answers 304.
+func fetchImage(client *http.Client, url string, cached *ImageRecord) (*fetchedImage, error) {
+	ImageRateLimiter.Wait()
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && cached.ETag != "" {
+		request.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached != nil && cached.LastModified != "" {
+		request.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return nil, errImageNotModified
+	}
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusForbidden {
+		return nil, errImageMissing // The CDN answers 403 for files that do not exist
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response status %q", response.Status)
+	}
+	contentType := response.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	buff, err := ioutil.ReadAll(response.Body) // Read image file from http response body
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(buff))
+	if err != nil {
+		return nil, fmt.Errorf("invalid jpeg image: %v", err)
+	}
+	bounds := img.Bounds()
+	return &fetchedImage{
+		Data:         buff,
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TEST: ParseImageVariants
+func TestParseImageVariants(t *testing.T) {
+	variants, err := ParseImageVariants("200w, 400w,original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 3 || variants[1] != "400w" || variants[2] != "original" {
+		t.Fatal("Expected [200w 400w original]  Got:", variants)
+	}
+	for _, list := range []string{"", "200", "large", "0w"} {
+		if _, err := ParseImageVariants(list); err == nil {
+			t.Fatalf("Expected error for %q", list)
+		}
+	}
+	if name := ImageVariant("original").RemoteName(42); name != "42_in_1000x1000.jpg" {
+		t.Fatal("Expected remote name 42_in_1000x1000.jpg  Got:", name)
+	}
+	if name := ImageVariant("400w").LocalName(7); name != "7_400w.jpg" {
+		t.Fatal("Expected local name 7_400w.jpg  Got:", name)
+	}
+}
+
+// testJPEG returns a small encoded JPEG image.
+func testJPEG(t *testing.T) []byte {
+	var buff bytes.Buffer
+	err := jpeg.Encode(&buff, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+// TEST: GetImages downloads valid variants and records the failed ones
+func TestGetImages(t *testing.T) {
+	jpegData := testJPEG(t)
+	var flakyCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/42_400w.jpg":
+			http.NotFound(w, r)
+			return
+		case "/43_200w.jpg": // Error page with a success status
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>Access denied</html>"))
+			return
+		case "/43_in_1000x1000.jpg": // Truncated image
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpegData[:len(jpegData)/2])
+			return
+		case "/43_400w.jpg": // Fails once, then succeeds
+			if atomic.AddInt32(&flakyCalls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultURL, defaultVariants, defaultDelay := TcgpImageURL, ImageVariants, ImageRetryDelay
+	TcgpImageURL, ImageVariants, ImageRetryDelay = server.URL, []ImageVariant{"200w", "400w", "original"}, 0
+	defer func() { TcgpImageURL, ImageVariants, ImageRetryDelay = defaultURL, defaultVariants, defaultDelay }()
+
+	var wg sync.WaitGroup
+	var failures ImageFailureLog
+	dataChan := make(chan []ProductMapping, 1)
+	wg.Add(1)
+	go GetImages(&wg, dataChan, store, nil, &failures, nil)
+	dataChan <- []ProductMapping{{ProductID: 42, CardID: 7}, {ProductID: 43, CardID: 8}}
+	TerminateCardImageGoroutines(&wg, dataChan, 1)
+
+	expected := map[string]bool{
+		"7_200w.jpg": true, "7_400w.jpg": false, "7_original.jpg": true,
+		"8_200w.jpg": false, "8_400w.jpg": true, "8_original.jpg": false,
+	}
+	for name, exists := range expected {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if (err == nil) != exists {
+			t.Fatalf("Expected %s to exist: %v", name, exists)
+		}
+	}
+	if n := len(failures.Failures()); n != 3 {
+		t.Fatal("Expected failures: 3  Got:", failures.Failures())
+	}
+}
+
+// TEST: writeFileAtomic replaces larger files and downloadImage skips intact images
+func TestSkipExistingImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "7_200w.jpg")
+	if err = writeFileAtomic(path, []byte("a much longer previous image")); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFileAtomic(path, []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "short" {
+		t.Fatalf("Expected file content %q  Got: %q", "short", data)
+	}
+
+	var requests int32
+	jpegData := testJPEG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+	defaultURL, defaultSkip := TcgpImageURL, SkipExistingImages
+	TcgpImageURL, SkipExistingImages = server.URL, true
+	defer func() { TcgpImageURL, SkipExistingImages = defaultURL, defaultSkip }()
+
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := ProductMapping{ProductID: 42, CardID: 7}
+	skipped, err := downloadImage(server.Client(), store, "200w", mapping, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != nil || requests != 0 {
+		t.Fatal("Expected the stored image without a manifest record to be skipped  Requests:", requests)
+	}
+
+	os.Remove(path)
+	record, err := downloadImage(server.Client(), store, "200w", mapping, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped, err = downloadImage(server.Client(), store, "200w", mapping, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != nil || requests != 1 {
+		t.Fatal("Expected the intact image to be skipped  Requests:", requests)
+	}
+
+	ioutil.WriteFile(path, jpegData[:10], 0644) // Damaged since the last run
+	_, err = downloadImage(server.Client(), store, "200w", mapping, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatal("Expected the damaged image to be downloaded again  Requests:", requests)
+	}
+}
+
+// TEST: downloadImage revalidates stored images and keeps them on 304 Not Modified
+func TestConditionalImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var downloads int32
+	etag := `"v1"`
+	jpegData := testJPEG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+	defaultURL := TcgpImageURL
+	TcgpImageURL = server.URL
+	defer func() { TcgpImageURL = defaultURL }()
+
+	mapping := ProductMapping{ProductID: 42, CardID: 7}
+	record, err := downloadImage(server.Client(), store, "200w", mapping, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ETag != etag || record.LastModified == "" {
+		t.Fatalf("Expected the response validators in the record  Got: %+v", record)
+	}
+	unchanged, err := downloadImage(server.Client(), store, "200w", mapping, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil || downloads != 1 {
+		t.Fatal("Expected a 304 response to keep the stored image  Downloads:", downloads)
+	}
+
+	etag = `"v2"`
+	changed, err := downloadImage(server.Client(), store, "200w", mapping, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == nil || changed.ETag != etag || downloads != 2 {
+		t.Fatal("Expected the changed image to be downloaded  Downloads:", downloads)
+	}
+}
+
+// TEST: StreamProductMappings pages through a product line by card id
+func TestStreamProductMappings(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	var mappings []ProductMapping
+	for i := uint(1); i <= 250; i++ {
+		mappings = append(mappings, ProductMapping{ProductID: 1000 + i, CardID: i, ProductLineID: 1 + i%2})
+	}
+	if tx := writeProductMappings(db, mappings); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	defaultBatchSize := ImageBatchSize
+	ImageBatchSize = 50
+	defer func() { ImageBatchSize = defaultBatchSize }()
+
+	dataChan := make(chan []ProductMapping, 10)
+	query := db.Model(&ProductMapping{}).Where("product_line_id = ?", 2)
+	err := StreamProductMappings(query, dataChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(dataChan)
+
+	var sizes []int
+	var lastCardID uint
+	for batch := range dataChan {
+		sizes = append(sizes, len(batch))
+		for _, elem := range batch {
+			if elem.CardID <= lastCardID || elem.ProductLineID != 2 {
+				t.Fatal("Expected ascending card ids of product line 2  Got:", elem)
+			}
+			lastCardID = elem.CardID
+		}
+	}
+	if len(sizes) != 3 || sizes[0] != 50 || sizes[2] != 25 {
+		t.Fatal("Expected batches: [50 50 25]  Got:", sizes)
+	}
+}
+
+// TEST: ImageProgress reports the cards finished by concurrent goroutines
+func TestImageProgress(t *testing.T) {
+	var output bytes.Buffer
+	progress := NewImageProgress(&output, 125)
+	var wg sync.WaitGroup
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				progress.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) > 101 || lines[len(lines)-1] != "Images: 100% (125 of 125 cards)" {
+		t.Fatal("Expected at most one line per percent ending at 100%  Got:", len(lines), lines[len(lines)-1])
+	}
+}
+
+// TEST: FetchImages fills in the images missing from the manifest of a selected set
+func TestFetchImages(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	var requests int32
+	jpegData := testJPEG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultURL, defaultVariants, defaultSkip := TcgpImageURL, ImageVariants, SkipExistingImages
+	TcgpImageURL, ImageVariants, SkipExistingImages = server.URL, []ImageVariant{"200w"}, true
+	defer func() { TcgpImageURL, ImageVariants, SkipExistingImages = defaultURL, defaultVariants, defaultSkip }()
+
+	mappings := []ProductMapping{
+		{ProductID: 41, CardID: 6, ProductLineID: 1, SetID: 10},
+		{ProductID: 42, CardID: 7, ProductLineID: 1, SetID: 10},
+		{ProductID: 43, CardID: 8, ProductLineID: 1, SetID: 11},
+	}
+	if tx := writeProductMappings(db, mappings); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	failures, err := FetchImages(db, store, ImageSelection{CardIDs: []uint{7}}.Query(db), 2, ioutil.Discard)
+	if err != nil || len(failures.Failures()) != 0 {
+		t.Fatal("Expected no failures  Got:", err, failures.Failures())
+	}
+
+	sel := ImageSelection{ProductLineID: 1, SetID: 10, MissingOnly: true}
+	var selected int64
+	sel.Query(db).Count(&selected)
+	if selected != 1 {
+		t.Fatal("Expected only card 6 to be selected  Got:", selected)
+	}
+	_, err = FetchImages(db, store, sel.Query(db), 2, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records int64
+	db.Model(&ImageRecord{}).Count(&records)
+	if requests != 2 || records != 2 {
+		t.Fatal("Expected images of cards 6 and 7  Requests:", requests, " Records:", records)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	tcm "github.com/gurbos/tcmodels"
 	"gorm.io/gorm/logger"
 )
 
@@ -16,7 +15,7 @@ func TestIntegration(t *testing.T) {
 
 	// Create database tables
 	dataSource := GetDataSource()
-	Migrate(dataSource.DSNString(), &tcm.ProductLine{}, &tcm.SetInfo{}, &tcm.YuGiOhCardInfo{}) // Create database tables
+	Migrate(dataSource.DSNString()) // Create database tables
 
 	dbconn := GetDBConnection(dataSource.DSNString(), logger.Silent)
 	err := DatabaseConnConfig(dbconn, 10, 10) // Configure the number of open database connections and idle connections
@@ -69,16 +68,9 @@ func TestIntegration(t *testing.T) {
 		go WriteCardInfo(&wg, dataChan, dbconn, setMap)
 	}
 
-	// Request card info by card set
-	for i := 0; i < 10; i++ {
-		requestInfo = GetRequestPayload(
-			"yugioh",
-			responseData.Results[0].Aggregations.ProductTypeName[0].URLValue,
-			responseData.Results[0].Aggregations.SetName[i].URLValue,
-			int(responseData.Results[0].Aggregations.SetName[i].Count),
-		)
-		requestChan <- requestInfo
-	}
+	// Request card info of the small card sets only
+	filter := SetFilter{MaxCards: 50}
+	requestSets(requestChan, "yugioh", responseData, filter.Select(responseData.Results[0].Aggregations.SetName, nil))
 
 	// Send go routines termination value
 	for i := 0; i < numCPUThread; i++ {
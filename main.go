@@ -7,15 +7,47 @@ import (
 	"os"
 	"runtime"
 	"runtime/pprof"
-	"sync"
+	"strings"
 
-	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpuprofile to file")
+var configFile = flag.String("config", "", "read the configuration from this YAML file (default "+DefaultConfigFile+" if present)")
+
+// Command is a subcommand of the scraper. Run parses the command's own flags from
+// args, see newFlagSet.
+type Command struct {
+	Name    string
+	Usage   string // Arguments following the command flags
+	Summary string
+	Run     func(cmd *Command, args []string)
+}
+
+// commands lists the subcommands in the order they are shown by "scraper help".
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{Name: "scrape", Usage: "[flags] [product line ...]", Summary: "scrape sets, cards and images of product lines", Run: scrapeCommand},
+		{Name: "sets", Usage: "[flags] <product line>", Summary: "list the sets of a product line", Run: setsCommand},
+		{Name: "images", Usage: "[flags] [product line]", Summary: "download images of cards already in the database", Run: imagesCommand},
+		{Name: "verify", Usage: "[product line]", Summary: "compare the image manifest with the image store", Run: verifyCommand},
+		{Name: "missing", Usage: "[flags] [product line]", Summary: "list card images missing from the image manifest", Run: missingCommand},
+		{Name: "prices", Usage: "[flags] [product line ...]", Summary: "record current card prices of product lines", Run: pricesCommand},
+		{Name: "export", Usage: "[flags] [product line]", Summary: "export scraped data as CSV, JSON Lines or a SQLite database", Run: exportCommand},
+		{Name: "migrate", Usage: "up [version] | down [steps] | status", Summary: "apply, revert or list schema migrations", Run: migrateCommand},
+		{Name: "clean", Usage: "[flags] [product line ...]", Summary: "delete product lines or drop all scraper tables", Run: cleanCommand},
+		{Name: "config", Usage: "show", Summary: "print the configuration with secrets redacted", Run: configCommand},
+		{Name: "status", Usage: "", Summary: "show the schema version and row counts per product line", Run: statusCommand},
+		{Name: "serve", Usage: "[flags]", Summary: "serve status, cards and images over HTTP", Run: serveCommand},
+		{Name: "help", Usage: "[command]", Summary: "show help for a command", Run: helpCommand},
+	}
+}
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -30,102 +62,198 @@ func main() {
 	numCPUThreads := runtime.NumCPU() * 2 // Get number of logical processors
 	runtime.GOMAXPROCS(numCPUThreads)     // Set max number of logical processors that can execute in parallel
 
-	// dataSource := GetDataSource()
-	var dataSource DataSourceName
-	dataSource.Init()
-	dbConn := GetDBConnection(dataSource.DSNString(), logger.Silent)
-	if dbConn.Error != nil {
-		log.Fatal("main.GetDBConnection: ", dbConn.Error)
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd := findCommand(flag.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "scraper: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
 	}
-	Migrate(dataSource.DSNString(), tcm.ProductLine{}, tcm.SetInfo{}, tcm.YuGiOhCardInfo{}, CardImageID{}) // Create temporary database table to hold card image association data
-	err := DatabaseConnConfig(dbConn, 10, 10)
+	if *configFile == "" {
+		*configFile = os.Getenv("TCG_CONFIG")
+	}
+	cfg, err := LoadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config = cfg
+	cmd.Run(cmd, flag.Args()[1:])
+}
 
-	cmdArgs := os.Args[1:]
-	for _, productLineName := range cmdArgs {
-		var response *ResponsePayload
-		requestInfo := GetRequestPayload(productLineName, "", "", 0)
-		for {
-			var tcgpErr *TcgpError
-			response, tcgpErr = MakeTcgPlayerRequest(requestInfo.ToJSON(), DefaultTimeout)
-			if tcgpErr != nil {
-				continue
-			}
-			break
-		}
-		tx := WriteProductLineInfo(dbConn, response.Results[0])
-		if tx.Error != nil {
-			DropTables(dbConn)
-			log.Fatal(tx.Error)
+// usage writes the global flags and the list of commands to stderr.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: scraper [-config file] [-cpuprofile file] <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun \"scraper help <command>\" for the flags of a command.")
+}
+
+// findCommand returns the command with the given name, or nil.
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
 		}
-		fmt.Println("Product line info written to database.")
+	}
+	return nil
+}
 
-		tx = WriteSetInfo(dbConn, response.Results[0].Aggregations)
-		if tx.Error != nil {
-			DropTables(dbConn)
-			log.Fatal(tx.Error)
+// newFlagSet returns the flag set of cmd. Its usage message shows the command
+// synopsis, summary and flags.
+func newFlagSet(cmd *Command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: scraper %s %s\n\n%s.\n", cmd.Name, cmd.Usage, strings.ToUpper(cmd.Summary[:1])+cmd.Summary[1:])
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(os.Stderr, "\nFlags:")
+			flags.PrintDefaults()
 		}
-		fmt.Println("Set info written to database.")
+	}
+	return flags
+}
 
-		var wg sync.WaitGroup
-		requestChan := make(chan *RequestPayload, numCPUThreads*2) // Buffered channel used to pass RequestPayloads
-		{
-			cardAttrChan := make(chan []CardAttrs, numCPUThreads*2) // Buffered channel used to pass lists of CardAttrs
-			setmap, err := MakeSetMap(dbConn, "yugioh")
-			if err != nil {
-				DropTables(dbConn)
-				log.Fatal(err)
-			}
+// helpCommand implements "scraper help [command]".
+func helpCommand(cmd *Command, args []string) {
+	if len(args) == 0 {
+		usage()
+		return
+	}
+	target := findCommand(args[0])
+	if target == nil {
+		log.Fatalf("help: unknown command %q", args[0])
+	}
+	target.Run(target, []string{"-h"})
+}
 
-			// Create data request and data write threads
-			wg.Add(numCPUThreads)
-			for i := 0; i < numCPUThreads; i++ {
-				go MakeDataRequest(requestChan, cardAttrChan)
-			}
-			for i := 0; i < numCPUThreads; i++ {
-				go WriteCardInfo(&wg, cardAttrChan, dbConn, setmap)
-			}
-		}
+/*****************************************************************************************/
 
-		totalSets := len(response.Results[0].Aggregations.SetName)
-		for i := 0; i < totalSets; i++ {
-			requestPayload := GetRequestPayload(
-				productLineName,
-				response.Results[0].Aggregations.ProductTypeName[0].URLValue,
-				response.Results[0].Aggregations.SetName[i].URLValue,
-				int(response.Results[0].Aggregations.SetName[i].Count),
-			)
-			requestChan <- requestPayload
+// parseFlags parses the flags of a command, which override the configuration, and
+// validates and applies the resulting configuration.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	applyConfig(true)
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		TerminateCardInfoGoroutines(&wg, requestChan, numCPUThreads) // Send MakeDataRequest goroutines termination value and wait for them to complete
+	})
+	return set
+}
 
-		cardIDChan := make(chan []CardImageID, numCPUThreads*2) // Buffered channel used to pass lists of CardImageID objects
-		wg.Add(numCPUThreads)
-		for i := 0; i < numCPUThreads; i++ {
-			go GetImages(&wg, cardIDChan)
+// applyConfig validates and applies the configuration. The database settings are only
+// validated if database is set.
+func applyConfig(database bool) {
+	err := config.validate(database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Apply()
+}
+
+// openDatabase connects to the configured database. If requireSchema is set, the
+// program exits unless all migrations are applied. Errors exit through fatal, so the
+// webhooks of a started run are notified.
+func openDatabase(requireSchema bool) *gorm.DB {
+	err := config.Database.RegisterTLS()
+	if err != nil {
+		fatal(err)
+	}
+	dbConn := GetDBConnection(config.Database.DSNString(), logger.Silent)
+	if dbConn.Error != nil {
+		fatal(fmt.Errorf("main.GetDBConnection: %v", dbConn.Error))
+	}
+	if !requireSchema {
+		return dbConn
+	}
+	version, err := SchemaVersionOf(dbConn)
+	if err != nil {
+		fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		fatal(fmt.Errorf("Database schema is at version %d, expected %d. Run \"scraper migrate up\" first.", version, LatestSchemaVersion()))
+	}
+	return dbConn
+}
+
+// workerFlags registers the -workers, -timeout and -rate-limit flags.
+func workerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&config.Workers, "workers", config.Workers, "number of concurrent requests")
+	flags.IntVar(&config.HTTP.Timeout, "timeout", config.HTTP.Timeout, "HTTP request timeout in seconds")
+	flags.Float64Var(&config.HTTP.RateLimit, "rate-limit", config.HTTP.RateLimit, "maximum tcgplayer requests per second, 0 for no limit")
+}
+
+// batchFlags registers the -batchsize and -batchlog flags. The returned function
+// registers the insert metrics on db.
+func batchFlags(flags *flag.FlagSet) func(db *gorm.DB) *BatchMetrics {
+	flags.IntVar(&config.BatchSize, "batchsize", config.BatchSize, "maximum number of rows per bulk insert")
+	batchLog := flags.Bool("batchlog", false, "print timing information for every bulk insert")
+	return func(db *gorm.DB) *BatchMetrics {
+		metrics := NewBatchMetrics()
+		if *batchLog {
+			metrics.Log = os.Stdout
+		}
+		err := metrics.Register(db)
+		if err != nil {
+			fatal(err)
 		}
+		return metrics
+	}
+}
+
+// imageStoreFlag registers the -image-store flag.
+func imageStoreFlag(flags *flag.FlagSet) {
+	flags.StringVar(&config.Images.Store, "image-store", config.Images.Store, "where images are stored: a directory, dir://, cas:// or s3:// URL")
+}
 
-		var count int64 = 0
-		var totalCards int64
-		var dataSetSize int = 100
-		tx = dbConn.Model(CardImageID{}).Count(&totalCards)
-		for count < totalCards {
-			dataList := make([]CardImageID, 100, 100)
-			tx = dbConn.Model(&CardImageID{}).Offset(int(count)).Limit(dataSetSize).Order("new_id ASC").Find(&dataList)
-			if tx.Error != nil {
-				DropTables(dbConn)
-				log.Fatal(tx.Error)
+// imageFlags registers the flags of the image stage.
+func imageFlags(flags *flag.FlagSet) {
+	imageStoreFlag(flags)
+	flags.Var((*listFlag)(&config.Images.Variants), "image-variants", "comma separated list of image sizes to download, e.g. 200w,400w,original")
+	flags.Var((*listFlag)(&config.Images.Derivatives), "image-derivatives", "comma separated list of images generated from every downloaded image, e.g. 100w,300w.png,png")
+	flags.IntVar(&config.Images.BatchSize, "image-batchsize", config.Images.BatchSize, "number of cards read from the database per image batch")
+	flags.BoolVar(&config.Images.SkipExisting, "skip-existing", config.Images.SkipExisting, "skip images that are in the image manifest with their recorded size, or stored under their file name without a manifest record")
+	flags.Float64Var(&config.Images.RateLimit, "image-rate-limit", config.Images.RateLimit, "maximum image requests per second, 0 for no limit")
+}
+
+// setFilterFlags registers the -sets, -include, -exclude, -min-cards, -max-cards and
+// -added-since flags. The returned function returns the SetFilter they describe.
+func setFilterFlags(flags *flag.FlagSet) func() *SetFilter {
+	filter := &SetFilter{}
+	flags.StringVar(&filter.Names, "sets", "", "only these comma separated set names or url names")
+	flags.Var((*setPatternFlag)(&filter.Include), "include", "only sets whose name or url name matches this glob, or regular expression prefixed with re:; may be repeated")
+	flags.Var((*setPatternFlag)(&filter.Exclude), "exclude", "skip sets whose name or url name matches this glob or re: regular expression; may be repeated")
+	flags.IntVar(&filter.MinCards, "min-cards", 0, "skip sets with fewer cards")
+	flags.IntVar(&filter.MaxCards, "max-cards", 0, "skip sets with more cards, 0 for no maximum")
+	since := flags.String("added-since", "", "only sets first seen on or after this date, YYYY-MM-DD")
+	return func() *SetFilter {
+		if *since != "" {
+			t, err := ParseSince(*since)
+			if err != nil {
+				log.Fatal(err)
 			}
-			cardIDChan <- dataList
-			count += tx.RowsAffected
-			fmt.Println("Images retrieved: ", count)
+			filter.AddedSince = t
 		}
-		TerminateCardImageGoroutines(&wg, cardIDChan, numCPUThreads)
+		return filter
 	}
-	err = dbConn.Migrator().DropTable(&CardImageID{})
-	if err != nil {
-		log.Fatal(err)
+}
+
+// productLines returns the product lines named in args, or the configured ones if
+// args is empty.
+func productLines(args []string) []string {
+	if len(args) > 0 {
+		return args
 	}
+	return config.ProductLines
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ImageRecord is an entry of the image manifest. It describes a card image variant
+// that has been downloaded successfully.
+type ImageRecord struct {
+	ID           uint      `gorm:"primarykey"`
+	CardID       uint      `gorm:"not null;uniqueIndex:idx_images_card_variant"`
+	ProductID    uint      `gorm:"not null;index"`
+	Variant      string    `gorm:"size:32;not null;uniqueIndex:idx_images_card_variant"`
+	Path         string    `gorm:"size:255;not null"` // Location in the image store
+	Size         int64     `gorm:"not null"`
+	SHA256       string    `gorm:"size:64;not null"`
+	Width        int       `gorm:"not null"`
+	Height       int       `gorm:"not null"`
+	FetchedAt    time.Time `gorm:"not null"`
+	ETag         string    `gorm:"column:etag;size:255"`         // ETag header of the response, used to revalidate the image
+	LastModified string    `gorm:"column:last_modified;size:64"` // Last-Modified header of the response
+}
+
+// TableName overrides the default table name of the ImageRecord model.
+func (ImageRecord) TableName() string {
+	return "images"
+}
+
+// ImageProblem describes a disagreement between the image manifest and the disk.
+type ImageProblem struct {
+	Path    string
+	CardID  uint // Zero for files that are not in the manifest
+	Variant string
+	Problem string
+}
+
+// MissingImage identifies a card image variant that is not in the image manifest.
+type MissingImage struct {
+	ProductMapping
+	Variant ImageVariant
+}
+
+// WriteImageRecord inserts record into the image manifest, replacing an existing
+// record of the same card and variant.
+func WriteImageRecord(db *gorm.DB, record *ImageRecord) error {
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "card_id"}, {Name: "variant"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"product_id", "path", "size", "sha256", "width", "height", "fetched_at", "etag", "last_modified",
+		}),
+	}).Create(record).Error
+}
+
+// imageRecordsOf returns a query for the manifest records of a product line. All
+// records are selected if productLineID is zero.
+func imageRecordsOf(db *gorm.DB, productLineID uint) *gorm.DB {
+	query := db.Model(&ImageRecord{})
+	if productLineID != 0 {
+		query = query.Where("card_id IN (?)", db.Model(&ProductMapping{}).Select("card_id").Where("product_line_id = ?", productLineID))
+	}
+	return query
+}
+
+// findImageRecord returns the manifest record of a card image variant, or nil.
+func findImageRecord(db *gorm.DB, cardID uint, variant ImageVariant) *ImageRecord {
+	var records []ImageRecord
+	tx := db.Where("card_id = ? AND variant = ?", cardID, string(variant)).Limit(1).Find(&records)
+	if tx.Error != nil || len(records) == 0 {
+		return nil
+	}
+	return &records[0]
+}
+
+// VerifyImages compares the image manifest with the blobs in store. It reports
+// manifest records whose blob is missing or has a different size or checksum.
+// When all product lines are verified, blobs without a manifest record are
+// reported as well.
+func VerifyImages(db *gorm.DB, store BlobStore, productLineID uint) ([]ImageProblem, error) {
+	var problems []ImageProblem
+	known := make(map[string]bool)
+
+	var records []ImageRecord
+	tx := imageRecordsOf(db, productLineID).FindInBatches(&records, 500, func(tx *gorm.DB, batch int) error {
+		for _, record := range records {
+			known[record.Path] = true
+			problem := verifyImageBlob(store, record)
+			if problem != "" {
+				problems = append(problems, ImageProblem{Path: record.Path, CardID: record.CardID, Variant: record.Variant, Problem: problem})
+			}
+		}
+		return nil
+	})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if productLineID != 0 {
+		return problems, nil
+	}
+
+	locations, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range locations {
+		if !isImageFile(location) || known[location] {
+			continue
+		}
+		problems = append(problems, ImageProblem{Path: location, Problem: "not in manifest"})
+	}
+	return problems, nil
+}
+
+// isImageFile reports whether location names a downloaded image or a derivative.
+func isImageFile(location string) bool {
+	return strings.HasSuffix(location, ".jpg") || strings.HasSuffix(location, ".png")
+}
+
+// verifyImageBlob returns a description of the difference between a stored blob and
+// its manifest record, or an empty string if they agree.
+func verifyImageBlob(store BlobStore, record ImageRecord) string {
+	data, err := store.Get(record.Path)
+	if err == errBlobNotFound {
+		return "file missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if int64(len(data)) != record.Size {
+		return fmt.Sprintf("size %d, manifest %d", len(data), record.Size)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != record.SHA256 {
+		return "checksum mismatch"
+	}
+	return ""
+}
+
+// checkImageBlob is the cheap form of verifyImageBlob used before every download. It
+// only compares the size of the stored blob with the manifest record; checksums are
+// left to the verify command.
+func checkImageBlob(store BlobStore, record ImageRecord) string {
+	size, err := store.Size(record.Path)
+	if err == errBlobNotFound {
+		return "file missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if size != record.Size {
+		return fmt.Sprintf("size %d, manifest %d", size, record.Size)
+	}
+	return ""
+}
+
+// MissingImages returns the card image variants of a product line that have no record
+// in the image manifest. All product lines are searched if productLineID is zero.
+func MissingImages(db *gorm.DB, productLineID uint, variants []ImageVariant) ([]MissingImage, error) {
+	var missing []MissingImage
+	for _, variant := range variants {
+		var mappings []ProductMapping
+		query := db.Model(&ProductMapping{}).
+			Joins("LEFT JOIN images ON images.card_id = product_mappings.card_id AND images.variant = ?", string(variant)).
+			Where("images.id IS NULL")
+		if productLineID != 0 {
+			query = query.Where("product_mappings.product_line_id = ?", productLineID)
+		}
+		tx := query.Order("product_mappings.card_id").Find(&mappings)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		for _, mapping := range mappings {
+			missing = append(missing, MissingImage{ProductMapping: mapping, Variant: variant})
+		}
+	}
+	return missing, nil
+}
+
+// PrintImageProblems writes a table of image problems to w.
+func PrintImageProblems(w io.Writer, problems []ImageProblem) {
+	fmt.Fprintf(w, "%-32s %-8s %-10s %s\n", "PATH", "CARD", "VARIANT", "PROBLEM")
+	for _, elem := range problems {
+		fmt.Fprintf(w, "%-32s %-8d %-10s %s\n", elem.Path, elem.CardID, elem.Variant, elem.Problem)
+	}
+	fmt.Fprintf(w, "Problems found: %d\n", len(problems))
+}
+
+// PrintMissingImages writes a table of missing image variants to w.
+func PrintMissingImages(w io.Writer, missing []MissingImage) {
+	fmt.Fprintf(w, "%-8s %-10s %s\n", "CARD", "PRODUCT", "VARIANT")
+	for _, elem := range missing {
+		fmt.Fprintf(w, "%-8d %-10d %s\n", elem.CardID, elem.ProductID, elem.Variant)
+	}
+	fmt.Fprintf(w, "Missing images: %d\n", len(missing))
+}
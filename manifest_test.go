@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TEST: GetImages fills the manifest, VerifyImages and MissingImages report disagreements
+func TestImageManifest(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	jpegData := testJPEG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/43_200w.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultURL, defaultVariants := TcgpImageURL, ImageVariants
+	TcgpImageURL, ImageVariants = server.URL, []ImageVariant{"200w"}
+	defer func() { TcgpImageURL, ImageVariants = defaultURL, defaultVariants }()
+
+	mappings := []ProductMapping{{ProductID: 41, CardID: 6}, {ProductID: 42, CardID: 7}, {ProductID: 43, CardID: 8}}
+	if tx := writeProductMappings(db, mappings); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	var wg sync.WaitGroup
+	var failures ImageFailureLog
+	dataChan := make(chan []ProductMapping, 1)
+	wg.Add(1)
+	go GetImages(&wg, dataChan, store, db, &failures, nil)
+	dataChan <- mappings
+	TerminateCardImageGoroutines(&wg, dataChan, 1)
+
+	var record ImageRecord
+	if tx := db.Where("card_id = ?", 7).First(&record); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	if record.Path != "7_200w.jpg" || record.Size != int64(len(jpegData)) || record.Width != 4 || len(record.SHA256) != 64 {
+		t.Fatalf("Unexpected manifest record: %+v", record)
+	}
+	problems, err := VerifyImages(db, store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatal("Expected no problems  Got:", problems)
+	}
+
+	os.Remove(filepath.Join(dir, "6_200w.jpg"))
+	ioutil.WriteFile(filepath.Join(dir, "7_200w.jpg"), []byte("garbage"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "9_200w.jpg"), jpegData, 0644)
+	problems, err = VerifyImages(db, store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatal("Expected problems: 3  Got:", problems)
+	}
+
+	missing, err := MissingImages(db, 0, []ImageVariant{"200w", "400w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 4 || missing[0].CardID != 8 || missing[0].Variant != "200w" {
+		t.Fatal("Expected card 8 missing 200w and all cards missing 400w  Got:", missing)
+	}
+}
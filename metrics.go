@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// batchStartKey is the gorm instance setting used to pass the start time
+// of an insert from the before-create callback to the after-create callback.
+const batchStartKey = "scraper:batch_start"
+
+// BatchStat holds the accumulated timing information of the bulk inserts
+// made into a single database table.
+type BatchStat struct {
+	Batches int           // Number of INSERT statements executed
+	Rows    int64         // Total number of rows written
+	Total   time.Duration // Total time spent executing the statements
+	Min     time.Duration // Duration of the fastest statement
+	Max     time.Duration // Duration of the slowest statement
+}
+
+// RowsPerSecond returns the average insert throughput.
+func (bs *BatchStat) RowsPerSecond() float64 {
+	if bs.Total <= 0 {
+		return 0
+	}
+	return float64(bs.Rows) / bs.Total.Seconds()
+}
+
+// BatchMetrics records the duration of every INSERT statement executed through
+// a gorm connection. Since CreateInBatches runs the create callbacks once per
+// chunk, every chunk is recorded as a separate batch.
+type BatchMetrics struct {
+	Log   io.Writer // If not nil, a line is written for every completed batch
+	mu    sync.Mutex
+	stats map[string]*BatchStat
+	order []string // Table names in the order they were first written to
+}
+
+// NewBatchMetrics returns an empty BatchMetrics object.
+func NewBatchMetrics() *BatchMetrics {
+	return &BatchMetrics{stats: make(map[string]*BatchStat)}
+}
+
+// Register installs the callbacks used to time the inserts made with db.
+func (bm *BatchMetrics) Register(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register("scraper:batch_start", func(tx *gorm.DB) {
+		tx.InstanceSet(batchStartKey, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+	return db.Callback().Create().After("gorm:create").Register("scraper:batch_end", func(tx *gorm.DB) {
+		val, ok := tx.InstanceGet(batchStartKey)
+		if !ok || tx.Error != nil {
+			return
+		}
+		bm.record(tx.Statement.Table, tx.RowsAffected, time.Since(val.(time.Time)))
+	})
+}
+
+// record adds a single batch to the statistics of the given table.
+func (bm *BatchMetrics) record(table string, rows int64, elapsed time.Duration) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	stat, ok := bm.stats[table]
+	if !ok {
+		stat = &BatchStat{Min: elapsed}
+		bm.stats[table] = stat
+		bm.order = append(bm.order, table)
+	}
+	stat.Batches++
+	stat.Rows += rows
+	stat.Total += elapsed
+	if elapsed < stat.Min {
+		stat.Min = elapsed
+	}
+	if elapsed > stat.Max {
+		stat.Max = elapsed
+	}
+	if bm.Log != nil {
+		fmt.Fprintf(bm.Log, "batch insert  %-24s %6d rows  %v\n", table, rows, elapsed)
+	}
+}
+
+// Stat returns a copy of the statistics recorded for the given table.
+func (bm *BatchMetrics) Stat(table string) (BatchStat, bool) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	stat, ok := bm.stats[table]
+	if !ok {
+		return BatchStat{}, false
+	}
+	return *stat, true
+}
+
+// Report writes a per table summary of the recorded batches to w.
+func (bm *BatchMetrics) Report(w io.Writer) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	fmt.Fprintf(w, "%-24s %8s %10s %12s %12s %12s %10s\n", "TABLE", "BATCHES", "ROWS", "AVG", "MIN", "MAX", "ROWS/S")
+	for _, name := range bm.order {
+		stat := bm.stats[name]
+		avg := stat.Total / time.Duration(stat.Batches)
+		fmt.Fprintf(w, "%-24s %8d %10d %12v %12v %12v %10.0f\n",
+			name, stat.Batches, stat.Rows, avg, stat.Min, stat.Max, stat.RowsPerSecond())
+	}
+}
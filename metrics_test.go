@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+)
+
+// TEST: BatchMetrics
+func TestBatchMetrics(t *testing.T) {
+	metrics := NewBatchMetrics()
+	metrics.record("set_infos", 500, 20*time.Millisecond)
+	metrics.record("set_infos", 120, 10*time.Millisecond)
+	metrics.record("yu_gi_oh_card_infos", 500, 40*time.Millisecond)
+
+	stat, ok := metrics.Stat("set_infos")
+	if !ok {
+		t.Fatal("Expected statistics for table set_infos")
+	}
+	if stat.Batches != 2 || stat.Rows != 620 {
+		t.Fatal("Expected batches: 2 rows: 620  Got batches:", stat.Batches, "rows:", stat.Rows)
+	}
+	if stat.Min != 10*time.Millisecond || stat.Max != 20*time.Millisecond {
+		t.Fatal("Expected min: 10ms max: 20ms  Got min:", stat.Min, "max:", stat.Max)
+	}
+	if rps := stat.RowsPerSecond(); rps < 20666 || rps > 20667 {
+		t.Fatal("Expected rows per second: 20666.67  Got:", rps)
+	}
+
+	var buff bytes.Buffer
+	metrics.Report(&buff)
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("Expected report lines: 3  Got:", len(lines))
+	}
+	if !strings.HasPrefix(lines[1], "set_infos") || !strings.HasPrefix(lines[2], "yu_gi_oh_card_infos") {
+		t.Fatal("Report rows are not in insertion order:\n", buff.String())
+	}
+}
+
+// TEST: BatchMetrics.Register times the batches of CreateInBatches
+func TestBatchMetricsRegister(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	metrics := NewBatchMetrics()
+	if err := metrics.Register(db); err != nil {
+		t.Fatal(err)
+	}
+	sets := make([]tcm.SetInfo, 25)
+	for i := range sets {
+		sets[i] = tcm.SetInfo{Name: "Set " + strconv.Itoa(i), ProductLineID: 1}
+	}
+	if tx := db.CreateInBatches(sets, 10); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	stat, ok := metrics.Stat("set_infos")
+	if !ok || stat.Batches != 3 || stat.Rows != 25 {
+		t.Fatal("Expected batches: 3 rows: 25  Got:", ok, stat.Batches, stat.Rows)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SchemaVersion records a migration that has been applied to the database.
+type SchemaVersion struct {
+	Version   uint      `gorm:"primarykey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// Migration is a numbered, reversible schema change. Up and Down receive the
+// Dialect of the database so dialect specific DDL can stay behind that interface.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(db *gorm.DB, dialect Dialect) error
+	Down    func(db *gorm.DB, dialect Dialect) error
+}
+
+// MigrationState is the status of a single migration in a specific database.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrations lists every schema change in the order it has to be applied. Entries
+// must never be edited or removed once released, add a new migration instead.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create product line, set and card tables",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return db.AutoMigrate(&productLineV1{}, &setInfoV1{}, &cardInfoV1{})
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return db.Migrator().DropTable(&cardInfoV1{}, &setInfoV1{}, &productLineV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "store card descriptions as utf8mb4",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return dialect.PrepareSchema(db)
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return dialect.RevertSchema(db)
+		},
+	},
+	{
+		Version: 3,
+		Name:    "keep tcgplayer product ids in product_mappings",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			err := dialect.DropTables(db, "card_image_ids") // Temporary table left behind by an interrupted run
+			if err != nil {
+				return err
+			}
+			return db.AutoMigrate(&productMappingV3{})
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return db.Migrator().DropTable(&productMappingV3{})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add image manifest",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return db.AutoMigrate(&imageRecordV4{})
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return db.Migrator().DropTable(&imageRecordV4{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "keep image validators in the image manifest",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			for _, column := range []string{"ETag", "LastModified"} {
+				if db.Migrator().HasColumn(&imageRecordV5{}, column) {
+					continue // Created by migration 4 before its schema was frozen
+				}
+				err := db.Migrator().AddColumn(&imageRecordV5{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			for _, column := range []string{"ETag", "LastModified"} {
+				err := db.Migrator().DropColumn(&imageRecordV5{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add card price history",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return db.AutoMigrate(&cardPriceV6{})
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return db.Migrator().DropTable(&cardPriceV6{})
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add known sets",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return db.AutoMigrate(&knownSetV7{})
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return db.Migrator().DropTable(&knownSetV7{})
+		},
+	},
+	{
+		Version: 8,
+		Name:    "record stored sets as known sets",
+		Up: func(db *gorm.DB, dialect Dialect) error {
+			return backfillKnownSets(db, time.Now())
+		},
+		Down: func(db *gorm.DB, dialect Dialect) error {
+			return nil // The recorded sets are indistinguishable from the ones seen by scrapes
+		},
+	},
+}
+
+// backfillKnownSets records the stored sets of every product line as known sets first
+// seen at seen, so the sets scraped before known sets were kept are not reported as new.
+// Set info rows have no creation time, so the time of the migration is used.
+func backfillKnownSets(db *gorm.DB, seen time.Time) error {
+	var productLines []productLineV1
+	if tx := db.Find(&productLines); tx.Error != nil {
+		return tx.Error
+	}
+	for _, productLine := range productLines {
+		var setInfos []setInfoV1
+		if tx := db.Where("product_line_id = ?", productLine.ID).Find(&setInfos); tx.Error != nil {
+			return tx.Error
+		}
+		if len(setInfos) == 0 {
+			continue
+		}
+		knownSets := make([]knownSetV7, len(setInfos))
+		for i, elem := range setInfos {
+			knownSets[i] = knownSetV7{ProductLine: strings.ToLower(productLine.Name), URLName: elem.URLName, Name: elem.Name, FirstSeen: seen}
+		}
+		tx := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(knownSets, InsertBatchSize)
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+	return nil
+}
+
+/*****************************************************************************************/
+
+// The tables as created by the migrations. Migrations must not use the models of the
+// scraper, which change with later migrations, but these frozen copies. A migration that
+// changes a table adds a new copy.
+
+type productLineV1 struct {
+	ID        uint `gorm:"primarykey"`
+	Name      string
+	URLName   string
+	SetCount  uint
+	CardCount uint
+}
+
+func (productLineV1) TableName() string { return "product_lines" }
+
+type setInfoV1 struct {
+	ID            uint `gorm:"primarykey"`
+	Name          string
+	URLName       string
+	CardCount     uint
+	ProductLineID uint
+}
+
+func (setInfoV1) TableName() string { return "set_infos" }
+
+type cardInfoV1 struct {
+	ID            uint `gorm:"primarykey"`
+	Attack        string
+	Attribute     string
+	CardType      string
+	CardTypeB     string
+	Defense       string
+	Description   string
+	LinkArrows    string
+	Level         string
+	MonsterType   string
+	Name          string
+	URLName       string
+	Number        string
+	Rarity        string
+	SetID         uint
+	ProductLineID uint
+}
+
+func (cardInfoV1) TableName() string { return "yu_gi_oh_card_infos" }
+
+type productMappingV3 struct {
+	ProductID     uint `gorm:"primarykey;autoIncrement:false"`
+	CardID        uint `gorm:"not null;uniqueIndex"`
+	ProductLineID uint `gorm:"not null;index"`
+	SetID         uint `gorm:"not null;index"`
+}
+
+func (productMappingV3) TableName() string { return "product_mappings" }
+
+type imageRecordV4 struct {
+	ID        uint      `gorm:"primarykey"`
+	CardID    uint      `gorm:"not null;uniqueIndex:idx_images_card_variant"`
+	ProductID uint      `gorm:"not null;index"`
+	Variant   string    `gorm:"size:32;not null;uniqueIndex:idx_images_card_variant"`
+	Path      string    `gorm:"size:255;not null"`
+	Size      int64     `gorm:"not null"`
+	SHA256    string    `gorm:"size:64;not null"`
+	Width     int       `gorm:"not null"`
+	Height    int       `gorm:"not null"`
+	FetchedAt time.Time `gorm:"not null"`
+}
+
+func (imageRecordV4) TableName() string { return "images" }
+
+type imageRecordV5 struct {
+	imageRecordV4
+	ETag         string `gorm:"column:etag;size:255"`
+	LastModified string `gorm:"column:last_modified;size:64"`
+}
+
+func (imageRecordV5) TableName() string { return "images" }
+
+type cardPriceV6 struct {
+	ID                      uint `gorm:"primarykey"`
+	CardID                  uint `gorm:"not null;index:idx_card_prices_card_time"`
+	ProductID               uint `gorm:"not null"`
+	MarketPrice             float64
+	LowestPrice             float64
+	LowestPriceWithShipping float64
+	Listings                int
+	FetchedAt               time.Time `gorm:"not null;index:idx_card_prices_card_time"`
+}
+
+func (cardPriceV6) TableName() string { return "card_prices" }
+
+type knownSetV7 struct {
+	ProductLine string    `gorm:"primarykey;size:100"`
+	URLName     string    `gorm:"primarykey;size:255"`
+	Name        string    `gorm:"size:255;not null"`
+	FirstSeen   time.Time `gorm:"not null;index"`
+}
+
+func (knownSetV7) TableName() string { return "known_sets" }
+
+// LatestSchemaVersion returns the version of the last migration.
+func LatestSchemaVersion() uint {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersionOf returns the version of the last migration applied to db. Zero
+// is returned for a database without a schema_versions table.
+func SchemaVersionOf(db *gorm.DB) (uint, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var version SchemaVersion
+	tx := db.Order("version DESC").Limit(1).Find(&version)
+	return version.Version, tx.Error
+}
+
+// MigrationStatus returns the state of every known migration in db.
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	applied := make(map[uint]SchemaVersion)
+	if db.Migrator().HasTable(&SchemaVersion{}) {
+		var versions []SchemaVersion
+		tx := db.Find(&versions)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		for _, elem := range versions {
+			applied[elem.Version] = elem
+		}
+	}
+
+	states := make([]MigrationState, len(Migrations))
+	for i, m := range Migrations {
+		version, ok := applied[m.Version]
+		states[i] = MigrationState{Migration: m, Applied: ok, AppliedAt: version.AppliedAt}
+	}
+	return states, nil
+}
+
+// MigrateUp applies the pending migrations up to and including the target version.
+// A target of zero applies all pending migrations. The applied migrations are returned.
+func MigrateUp(db *gorm.DB, target uint) ([]Migration, error) {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&SchemaVersion{})
+	if err != nil {
+		return nil, err
+	}
+	current, err := SchemaVersionOf(db)
+	if err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = LatestSchemaVersion()
+	}
+
+	var applied []Migration
+	for _, m := range Migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		err = m.Up(db, dialect)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		tx := db.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()})
+		if tx.Error != nil {
+			return applied, tx.Error
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first. The
+// reverted migrations are returned.
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+	current, err := SchemaVersionOf(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(Migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := Migrations[i]
+		if m.Version > current {
+			continue
+		}
+		err = m.Down(db, dialect)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		tx := db.Delete(&SchemaVersion{}, m.Version)
+		if tx.Error != nil {
+			return reverted, tx.Error
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// PrintMigrationStatus writes a table of migration states to w.
+func PrintMigrationStatus(w io.Writer, states []MigrationState) {
+	fmt.Fprintf(w, "%-8s %-8s %-20s %s\n", "VERSION", "STATE", "APPLIED AT", "NAME")
+	for _, elem := range states {
+		state, appliedAt := "pending", ""
+		if elem.Applied {
+			state, appliedAt = "applied", elem.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%-8d %-8s %-20s %s\n", elem.Version, state, appliedAt, elem.Name)
+	}
+}
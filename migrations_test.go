@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// TEST: MigrateUp, MigrateDown and MigrationStatus
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := DataSourceName{Driver: "sqlite", Database: filepath.Join(dir, "tcg.db")}
+	db := GetDBConnection(ds.DSNString(), logger.Silent)
+
+	applied, err := MigrateUp(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || !db.Migrator().HasTable(&tcm.YuGiOhCardInfo{}) {
+		t.Fatal("Expected migration 1 to create the card table")
+	}
+
+	applied, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations)-1 {
+		t.Fatal("Expected applied migrations:", len(Migrations)-1, " Got:", len(applied))
+	}
+	version, err := SchemaVersionOf(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatal("Expected version:", LatestSchemaVersion(), " Got:", version)
+	}
+
+	// TEST: The frozen tables of the migrations have the columns of the current models
+	for _, model := range OwnedModels {
+		stmt := &gorm.Statement{DB: db}
+		if err = stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Fatal("Expected column", stmt.Schema.Table+"."+field.DBName)
+			}
+		}
+	}
+
+	reverted, err := MigrateDown(db, len(Migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(Migrations) || db.Migrator().HasTable(&tcm.YuGiOhCardInfo{}) {
+		t.Fatal("Expected all migrations to be reverted")
+	}
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, elem := range states {
+		if elem.Applied {
+			t.Fatal("Expected migration", elem.Version, "to be pending")
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// The events a run notifies webhooks of, see WebhookTarget.
+const (
+	EventCompleted  = "completed"   // The run finished without errors
+	EventFailed     = "failed"      // The run stopped with an error
+	EventNewSets    = "new_sets"    // Sets were listed for the first time, see KnownSet
+	EventPriceMoves = "price_moves" // Market prices changed by at least NotifyConfig.PriceChange percent
+)
+
+// NotifyEvents lists the events of a run.
+var NotifyEvents = []string{EventCompleted, EventFailed, EventNewSets, EventPriceMoves}
+
+// SignatureHeader holds the HMAC-SHA256 of the body of a notification, keyed with the
+// secret of the target, as "sha256=" followed by the hex encoded MAC.
+const SignatureHeader = "X-Scraper-Signature"
+
+// WebhookBackoff is the delay before the first retry of a notification. It doubles with
+// every further retry.
+var WebhookBackoff = 2 * time.Second
+
+// currentRun is the run whose webhooks are notified when the command fails, see fatal.
+var currentRun *Run
+
+// RunSummary is the JSON body of a notification.
+type RunSummary struct {
+	RunID        string           `json:"run_id"`
+	Command      string           `json:"command"`
+	Events       []string         `json:"events"` // The events of the run the target listens to
+	ProductLines []string         `json:"product_lines"`
+	StartedAt    time.Time        `json:"started_at"`
+	FinishedAt   time.Time        `json:"finished_at"`
+	Duration     float64          `json:"duration_seconds"`
+	Counts       map[string]int64 `json:"counts"` // e.g. sets, cards or prices
+	Errors       []string         `json:"errors"`
+	NewSets      []NewSet         `json:"new_sets"`
+	PriceChanges []PriceChange    `json:"price_changes"` // Largest first
+}
+
+// NewSet is a set listed for the first time by a run.
+type NewSet struct {
+	ProductLine string `json:"product_line"`
+	Name        string `json:"name"`
+	URLName     string `json:"url_name"`
+}
+
+// PriceChange is the change of the market price of a card during a run.
+type PriceChange struct {
+	CardID    uint    `json:"card_id"`
+	ProductID uint    `json:"product_id"`
+	Name      string  `json:"name"`
+	OldPrice  float64 `json:"old_price"`
+	NewPrice  float64 `json:"new_price"`
+	Change    float64 `json:"change_percent"`
+}
+
+// Run collects the summary of a scrape or prices command and notifies the configured
+// webhooks of it when it finishes. It is safe for concurrent use.
+type Run struct {
+	mu       sync.Mutex
+	summary  RunSummary
+	notify   NotifyConfig
+	client   *http.Client
+	finished bool
+}
+
+// StartRun returns a new Run of command with a random run id, and makes it the run
+// notified by fatal.
+func StartRun(command string, productLines []string, notify NotifyConfig) *Run {
+	id := make([]byte, 8)
+	rand.Read(id)
+	currentRun = &Run{
+		summary: RunSummary{
+			RunID:        hex.EncodeToString(id),
+			Command:      command,
+			ProductLines: productLines,
+			StartedAt:    time.Now(),
+			Counts:       make(map[string]int64),
+		},
+		notify: notify,
+		client: &http.Client{Timeout: time.Duration(DefaultTimeout) * time.Second},
+	}
+	return currentRun
+}
+
+// StartedAt returns the time the run started.
+func (run *Run) StartedAt() time.Time {
+	return run.summary.StartedAt
+}
+
+// Notifies reports whether any webhook is configured, so the changes of the run need
+// to be collected.
+func (run *Run) Notifies() bool {
+	return len(run.notify.Targets) > 0
+}
+
+// Count adds n to the named count.
+func (run *Run) Count(name string, n int64) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.summary.Counts[name] += n
+}
+
+// AddError records an error that did not stop the run.
+func (run *Run) AddError(err error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.summary.Errors = append(run.summary.Errors, err.Error())
+}
+
+// AddNewSets records sets of a product line listed for the first time.
+func (run *Run) AddNewSets(productLine string, sets []itemInfo) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	for _, set := range sets {
+		run.summary.NewSets = append(run.summary.NewSets, NewSet{ProductLine: productLine, Name: set.Value, URLName: set.URLValue})
+	}
+}
+
+// SetPriceChanges records the price changes of the run, see PriceChanges.
+func (run *Run) SetPriceChanges(changes []PriceChange) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.summary.PriceChanges = changes
+}
+
+// Finish completes the summary, as failed if err is not nil, and posts it to every
+// target that listens to one of the events of the run. Notifications that cannot be
+// delivered are logged. Only the first call has an effect.
+func (run *Run) Finish(err error) {
+	run.mu.Lock()
+	if run.finished {
+		run.mu.Unlock()
+		return
+	}
+	run.finished = true
+	summary := run.summary
+	summary.Counts = make(map[string]int64, len(run.summary.Counts))
+	for name, n := range run.summary.Counts {
+		summary.Counts[name] = n
+	}
+	summary.Errors = append([]string(nil), run.summary.Errors...)
+	summary.NewSets = append([]NewSet(nil), run.summary.NewSets...)
+	run.mu.Unlock() // Posting may retry for a long time, see postNotification
+	summary.FinishedAt = time.Now()
+	summary.Duration = summary.FinishedAt.Sub(summary.StartedAt).Seconds()
+	var events []string
+	if err != nil {
+		summary.Errors = append(summary.Errors, err.Error())
+		events = append(events, EventFailed)
+	} else {
+		events = append(events, EventCompleted)
+	}
+	if len(summary.NewSets) > 0 {
+		events = append(events, EventNewSets)
+	}
+	if len(summary.PriceChanges) > 0 {
+		events = append(events, EventPriceMoves)
+	}
+
+	for _, target := range run.notify.Targets {
+		summary.Events = target.listensTo(events)
+		if len(summary.Events) == 0 {
+			continue
+		}
+		body, jsonErr := json.Marshal(summary)
+		if jsonErr != nil {
+			log.Println("notify:", jsonErr)
+			continue
+		}
+		deliveryErr := postNotification(run.client, target, body, run.notify.Retries)
+		if deliveryErr != nil {
+			log.Println("notify:", deliveryErr)
+		}
+	}
+}
+
+// fatal notifies the webhooks of currentRun, if there is one, that the run failed with
+// err and exits, see log.Fatal.
+func fatal(err error) {
+	if currentRun != nil {
+		currentRun.Finish(err)
+	}
+	log.Fatal(err)
+}
+
+// listensTo returns the events of events the target listens to. A target without events
+// listens to all of them.
+func (target WebhookTarget) listensTo(events []string) []string {
+	if len(target.Events) == 0 {
+		return events
+	}
+	var selected []string
+	for _, event := range events {
+		for _, elem := range target.Events {
+			if elem == event {
+				selected = append(selected, event)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// postNotification posts body to the target, signed with the secret of the target if
+// it has one. Network errors, 429 and 5xx responses are retried up to retries times,
+// waiting WebhookBackoff before the first retry and twice as long before every other.
+func postNotification(client *http.Client, target WebhookTarget, body []byte, retries int) error {
+	delay := WebhookBackoff
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		retry, err = sendNotification(client, target, body)
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("webhook %s: %v", redactURL(target.URL), err)
+	}
+	return nil
+}
+
+// sendNotification posts body to the target once. It returns whether a failed request
+// may succeed when it is retried.
+func sendNotification(client *http.Client, target WebhookTarget, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if target.Secret != "" {
+		request.Header.Set(SignatureHeader, SignBody(target.Secret, body))
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return false, nil
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected response status %q", response.Status)
+}
+
+// redactURL returns the scheme and host of rawURL, which leaves out tokens in the path
+// or query of webhook URLs.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// SignBody returns the value of the SignatureHeader of body for secret.
+func SignBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PriceChanges returns the cards whose latest market price fetched at or after since
+// differs by at least minPercent percent from their latest market price fetched before
+// it, largest change first. At most limit changes are returned, all if limit is zero.
+// Cards without an earlier price, or with an earlier price of zero, are left out.
+func PriceChanges(db *gorm.DB, since time.Time, minPercent float64, limit int) ([]PriceChange, error) {
+	cards, err := tableName(db, &tcm.YuGiOhCardInfo{})
+	if err != nil {
+		return nil, err
+	}
+	latestPrice := "(SELECT p.market_price FROM card_prices p WHERE p.card_id = c.id AND p.fetched_at %s ? ORDER BY p.fetched_at DESC, p.id DESC LIMIT 1) AS %s"
+	var rows []struct {
+		CardID    uint
+		ProductID uint
+		Name      string
+		OldPrice  *float64
+		NewPrice  *float64
+	}
+	tx := db.Table(cards+" AS c").
+		Select("c.id AS card_id, pm.product_id, c.name, "+fmt.Sprintf(latestPrice, "<", "old_price")+", "+fmt.Sprintf(latestPrice, ">=", "new_price"), since, since).
+		Joins("LEFT JOIN product_mappings pm ON pm.card_id = c.id").
+		Where("c.id IN (SELECT card_id FROM card_prices WHERE fetched_at >= ?)", since).
+		Scan(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var changes []PriceChange
+	for _, row := range rows {
+		if row.OldPrice == nil || row.NewPrice == nil || *row.OldPrice == 0 {
+			continue
+		}
+		change := (*row.NewPrice - *row.OldPrice) / *row.OldPrice * 100
+		if math.Abs(change) < minPercent || change == 0 {
+			continue
+		}
+		changes = append(changes, PriceChange{
+			CardID:    row.CardID,
+			ProductID: row.ProductID,
+			Name:      row.Name,
+			OldPrice:  *row.OldPrice,
+			NewPrice:  *row.NewPrice,
+			Change:    math.Round(change*100) / 100,
+		})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return math.Abs(changes[i].Change) > math.Abs(changes[j].Change)
+	})
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
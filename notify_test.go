@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TEST: Run posts a signed summary to the targets that listen to its events, retrying failed requests
+func TestNotify(t *testing.T) {
+	defer func(backoff time.Duration) { WebhookBackoff = backoff }(WebhookBackoff)
+	WebhookBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var attempts int
+	var received []RunSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != SignBody("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var summary RunSummary
+		if err := json.Unmarshal(body, &summary); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, summary)
+	}))
+	defer server.Close()
+
+	notify := NotifyConfig{
+		Targets: []WebhookTarget{
+			{URL: server.URL + "/all", Secret: "s3cret"},
+			{URL: server.URL + "/failures", Secret: "s3cret", Events: []string{EventFailed}},
+		},
+		Retries: 2,
+	}
+	run := StartRun("scrape", []string{"YuGiOh"}, notify)
+	defer func() { currentRun = nil }()
+	run.Count("cards", 40)
+	run.Count("cards", 2)
+	run.AddNewSets("YuGiOh", []itemInfo{{Value: "Metal Raiders", URLValue: "metal-raiders"}})
+	run.AddError(errors.New("sink webhook: unexpected response status"))
+	run.Finish(nil)
+	run.Finish(nil)
+
+	if attempts != 2 || len(received) != 1 {
+		t.Fatal("Expected one notification delivered on the second attempt  Got:", attempts, received)
+	}
+	summary := received[0]
+	if summary.RunID == "" || summary.Command != "scrape" || summary.Counts["cards"] != 42 || len(summary.Errors) != 1 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+	if len(summary.Events) != 2 || summary.Events[0] != EventCompleted || summary.Events[1] != EventNewSets {
+		t.Fatal("Expected the completed and new_sets events  Got:", summary.Events)
+	}
+	if len(summary.NewSets) != 1 || summary.NewSets[0].URLName != "metal-raiders" {
+		t.Fatal("Expected the new set  Got:", summary.NewSets)
+	}
+
+	// TEST: A failed run notifies the targets that listen to failures
+	received = nil
+	run = StartRun("prices", []string{"YuGiOh"}, notify)
+	run.Finish(errors.New("connection refused"))
+	if len(received) != 2 || received[1].Events[0] != EventFailed || received[1].Errors[0] != "connection refused" {
+		t.Fatal("Expected both targets to be notified of the failure  Got:", received)
+	}
+
+	// TEST: Requests that fail with a client error are not retried
+	attempts = 1 // Past the unavailable first attempt
+	err := postNotification(http.DefaultClient, WebhookTarget{URL: server.URL, Secret: "wrong"}, []byte("{}"), 3)
+	if err == nil || attempts != 2 {
+		t.Fatal("Expected one rejected attempt  Got:", attempts, err)
+	}
+
+	// TEST: Finish does not hold the run while it posts
+	var late *Run
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		late.Count("cards", 1) // Blocks if Finish holds the run
+	}))
+	defer blocking.Close()
+	late = StartRun("scrape", nil, NotifyConfig{Targets: []WebhookTarget{{URL: blocking.URL}}})
+	finished := make(chan bool)
+	go func() {
+		late.Finish(nil)
+		finished <- true
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Finish to release the run before posting")
+	}
+}
+
+// TEST: PriceChanges returns the largest price moves since a time
+func TestPriceChanges(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	cards := seedProductLine(t, db, "YuGiOh", 4)
+	since := time.Now().Add(-time.Hour)
+	before, after := since.Add(-time.Hour), since.Add(time.Minute)
+	prices := []CardPrice{
+		{CardID: cards[0].ID, MarketPrice: 10, FetchedAt: before.Add(-time.Hour)},
+		{CardID: cards[0].ID, MarketPrice: 1, FetchedAt: before},
+		{CardID: cards[0].ID, MarketPrice: 1.5, FetchedAt: after}, // +50%
+		{CardID: cards[1].ID, MarketPrice: 4, FetchedAt: before},
+		{CardID: cards[1].ID, MarketPrice: 1, FetchedAt: after}, // -75%
+		{CardID: cards[2].ID, MarketPrice: 4, FetchedAt: before},
+		{CardID: cards[2].ID, MarketPrice: 4.2, FetchedAt: after}, // +5%
+		{CardID: cards[3].ID, MarketPrice: 2, FetchedAt: after},   // No earlier price
+	}
+	if tx := db.Create(&prices); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	changes, err := PriceChanges(db, since, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].CardID != cards[1].ID || changes[0].Change != -75 || changes[1].Change != 50 {
+		t.Fatalf("Expected the -75%% and +50%% changes  Got: %+v", changes)
+	}
+	if changes[0].ProductID != cards[1].ID+1000 || changes[0].OldPrice != 4 || changes[0].NewPrice != 1 {
+		t.Fatalf("Unexpected change: %+v", changes[0])
+	}
+	changes, _ = PriceChanges(db, since, 0, 1)
+	if len(changes) != 1 {
+		t.Fatal("Expected the number of changes to be limited  Got:", len(changes))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CardPrice is a price observation of a card. A new row is written every time prices
+// are scraped, so the table holds the price history of every card.
+type CardPrice struct {
+	ID                      uint    `gorm:"primarykey"`
+	CardID                  uint    `gorm:"not null;index:idx_card_prices_card_time"`
+	ProductID               uint    `gorm:"not null"`
+	MarketPrice             float64 // Prices are in US dollars
+	LowestPrice             float64
+	LowestPriceWithShipping float64
+	Listings                int       // Number of listings the lowest prices were taken from
+	FetchedAt               time.Time `gorm:"not null;index:idx_card_prices_card_time"`
+}
+
+// WriteCardPrices is meant to be executed as a goroutine. It reads card listings from
+// dataChan and records the prices of the listed cards. Listings of products without a
+// product mapping are skipped and counted in unmapped.
+func WriteCardPrices(wg *sync.WaitGroup, dataChan chan []CardAttrs, db *gorm.DB, unmapped *int64) {
+	defer wg.Done()
+
+	for true {
+		data := <-dataChan
+		if data == nil {
+			break
+		}
+		productIDs := make([]uint, len(data))
+		for i := range data {
+			productIDs[i] = uint(data[i].ProductID)
+		}
+		cardIDs, err := LookupCardIDs(db, productIDs)
+		if err != nil {
+			fatal(err)
+		}
+		priceList, skipped := makeCardPriceList(data, cardIDs, time.Now())
+		atomic.AddInt64(unmapped, int64(skipped))
+		if len(priceList) > 0 {
+			tx := db.CreateInBatches(priceList, InsertBatchSize)
+			if tx.Error != nil {
+				fatal(tx.Error)
+			}
+		}
+		fmt.Printf("%-60s  %d\n", data[0].SetName, len(priceList))
+	}
+}
+
+// makeCardPriceList returns the prices of the listed cards that have an entry in
+// cardIDs, see LookupCardIDs, and the number of listings without one.
+func makeCardPriceList(attrList []CardAttrs, cardIDs map[uint]uint, fetchedAt time.Time) ([]CardPrice, int) {
+	priceList := make([]CardPrice, 0, len(attrList))
+	for _, attr := range attrList {
+		cardID, ok := cardIDs[uint(attr.ProductID)]
+		if !ok {
+			continue
+		}
+		priceList = append(priceList, CardPrice{
+			CardID:                  cardID,
+			ProductID:               uint(attr.ProductID),
+			MarketPrice:             roundCents(attr.MarketPrice),
+			LowestPrice:             roundCents(attr.LowestPrice),
+			LowestPriceWithShipping: roundCents(attr.LowestPriceWithShipping),
+			Listings:                attr.TotaListings,
+			FetchedAt:               fetchedAt,
+		})
+	}
+	return priceList, len(attrList) - len(priceList)
+}
+
+// roundCents converts a price decoded as float32 to float64 without the rounding noise
+// of the conversion, e.g. 0.16 instead of 0.1599999964237213.
+func roundCents(price float32) float64 {
+	return math.Round(float64(price)*100) / 100
+}
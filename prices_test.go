@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TEST: makeCardPriceList skips unmapped products and rounds prices to cents
+func TestCardPrices(t *testing.T) {
+	attrs := []CardAttrs{
+		{ProductID: 1001, MarketPrice: 0.16, LowestPrice: 0.1, TotaListings: 7},
+		{ProductID: 1002, MarketPrice: 3},
+	}
+	now := time.Now()
+	priceList, skipped := makeCardPriceList(attrs, map[uint]uint{1001: 1}, now)
+	if skipped != 1 || len(priceList) != 1 {
+		t.Fatal("Expected prices: 1 skipped: 1  Got:", len(priceList), skipped)
+	}
+	if priceList[0].CardID != 1 || priceList[0].MarketPrice != 0.16 || priceList[0].Listings != 7 || !priceList[0].FetchedAt.Equal(now) {
+		t.Fatalf("Unexpected price: %+v", priceList[0])
+	}
+
+	db, done := testDB(t)
+	defer done()
+	cards := seedProductLine(t, db, "YuGiOh", 1)
+	attrs[0].ProductID = float32(cards[0].ID + 1000)
+	var wg sync.WaitGroup
+	var unmapped int64
+	dataChan := make(chan []CardAttrs, 2)
+	wg.Add(1)
+	go WriteCardPrices(&wg, dataChan, db, &unmapped)
+	dataChan <- attrs
+	dataChan <- nil
+	wg.Wait()
+
+	var prices []CardPrice
+	db.Find(&prices)
+	if len(prices) != 1 || prices[0].CardID != cards[0].ID || unmapped != 1 {
+		t.Fatal("Expected one recorded price and one unmapped product  Got:", prices, unmapped)
+	}
+}
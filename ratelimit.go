@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TcgpRateLimiter limits the requests made to TcgpDataURL. It is nil, and does not
+// limit, unless a rate limit is configured.
+var TcgpRateLimiter *RateLimiter
+
+// ImageRateLimiter limits the requests made to TcgpImageURL, see TcgpRateLimiter.
+var ImageRateLimiter *RateLimiter
+
+// RateLimiter spaces events evenly so that no more than a given number happen per
+// second. It is safe for concurrent use. A nil *RateLimiter does not limit.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time // Earliest time of the next event
+}
+
+// NewRateLimiter returns a RateLimiter for perSecond events per second, or nil if
+// perSecond is not positive.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the next event may happen.
+func (rl *RateLimiter) Wait() {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.interval)
+	rl.mu.Unlock()
+	time.Sleep(delay)
+}
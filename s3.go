@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store stores blobs in a bucket of an S3-compatible object store such as AWS S3
+// or MinIO. Requests use path-style URLs and are signed with AWS Signature Version 4.
+// The location of a blob is its key.
+type S3Store struct {
+	Endpoint  string // Base URL of the object store, e.g. http://localhost:9000
+	Bucket    string
+	Prefix    string // Prepended to every key
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewS3Store returns an S3Store for a URL of the form
+//
+//	s3://<bucket>[/<prefix>][?endpoint=<base url>&region=<region>]
+//
+// The endpoint defaults to AWS S3 in the given region, and the region to us-east-1.
+// Credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables.
+func NewS3Store(u *url.URL) (*S3Store, error) {
+	store := S3Store{
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		Region:    u.Query().Get("region"),
+		Endpoint:  strings.TrimSuffix(u.Query().Get("endpoint"), "/"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Client:    &http.Client{Timeout: time.Duration(DefaultTimeout) * time.Second},
+	}
+	if store.Bucket == "" {
+		return nil, errors.New("s3 image store: no bucket given")
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.Endpoint == "" {
+		store.Endpoint = "https://s3." + store.Region + ".amazonaws.com"
+	}
+	if store.AccessKey == "" || store.SecretKey == "" {
+		return nil, errors.New("s3 image store: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return &store, nil
+}
+
+// objectURL returns the path-style URL of the object with the given key.
+func (s3 *S3Store) objectURL(key string) string {
+	if s3.Prefix != "" {
+		key = s3.Prefix + "/" + key
+	}
+	return s3.Endpoint + "/" + s3.Bucket + "/" + awsURIEncode(key, false)
+}
+
+// Put uploads data as the object key.
+func (s3 *S3Store) Put(key string, data []byte) (string, error) {
+	request, err := http.NewRequest(http.MethodPut, s3.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	request.Header.Set("Content-Type", contentType)
+	_, err = s3.do(request, data)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Get downloads the object at location.
+func (s3 *S3Store) Get(location string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, s3.objectURL(location), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s3.do(request, nil)
+}
+
+// Size returns the content length of the object at location, see a HEAD request.
+func (s3 *S3Store) Size(location string) (int64, error) {
+	request, err := http.NewRequest(http.MethodHead, s3.objectURL(location), nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := s3.send(request, nil)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.ContentLength, nil
+}
+
+// listBucketResult is the part of the ListObjectsV2 response used by List.
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the keys of all objects below the store's prefix.
+func (s3 *S3Store) List() ([]string, error) {
+	prefix := ""
+	if s3.Prefix != "" {
+		prefix = s3.Prefix + "/"
+	}
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		request, err := http.NewRequest(http.MethodGet, s3.Endpoint+"/"+s3.Bucket+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := s3.do(request, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(elem.Key, prefix))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do signs and sends request and returns the response body, see send.
+func (s3 *S3Store) do(request *http.Request, payload []byte) ([]byte, error) {
+	response, err := s3.send(request, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+// send signs and sends request. A 404 response is returned as errBlobNotFound, other
+// non 2xx responses as errors. The caller closes the body of the returned response.
+func (s3 *S3Store) send(request *http.Request, payload []byte) (*http.Response, error) {
+	sum := sha256.Sum256(payload)
+	signV4(request, hex.EncodeToString(sum[:]), s3.AccessKey, s3.SecretKey, s3.Region, "s3", time.Now())
+
+	response, err := s3.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return response, nil
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", request.Method, request.URL.Path, response.Status)
+}
+
+/*****************************************************************************************/
+
+// signV4 adds the headers of an AWS Signature Version 4 to request. All headers
+// already set on request are included in the signature.
+func signV4(request *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: lower case names, sorted, including the host header
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query string: sorted by name, names and values URI encoded
+	query := request.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalURI := request.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalURI,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes every byte of s except the unreserved characters
+// A-Z, a-z, 0-9, '-', '.', '_' and '~'. Slashes are only encoded if encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var buff strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			buff.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buff.WriteByte(c)
+		default:
+			fmt.Fprintf(&buff, "%%%02X", c)
+		}
+	}
+	return buff.String()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// CardResponse is the body of the /cards/<id> endpoint of the serve command.
+type CardResponse struct {
+	Card      tcm.YuGiOhCardInfo `json:"card"`
+	ProductID uint               `json:"product_id,omitempty"`
+	Images    []ImageRecord      `json:"images"`
+	Price     *CardPrice         `json:"price,omitempty"` // Latest price observation
+}
+
+// NewServer returns the HTTP handler of the serve command. It answers
+//
+//	GET /status              database status, see GetStatus
+//	GET /cards/<id>          a card with its images and latest price, see CardResponse
+//	GET /images/<location>   a blob of the image store
+//
+// All responses but images are JSON encoded.
+func NewServer(db *gorm.DB, store BlobStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := GetStatus(db)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("/cards/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/cards/"), 10, 32)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var response CardResponse
+		tx := db.Limit(1).Find(&response.Card, id)
+		if tx.Error != nil {
+			serverError(w, tx.Error)
+			return
+		}
+		if tx.RowsAffected == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		var mapping ProductMapping
+		db.Where("card_id = ?", id).Limit(1).Find(&mapping)
+		response.ProductID = mapping.ProductID
+		tx = db.Where("card_id = ?", id).Order("variant").Find(&response.Images)
+		if tx.Error != nil {
+			serverError(w, tx.Error)
+			return
+		}
+		var prices []CardPrice
+		db.Where("card_id = ?", id).Order("fetched_at DESC").Limit(1).Find(&prices)
+		if len(prices) > 0 {
+			response.Price = &prices[0]
+		}
+		writeJSON(w, response)
+	})
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+		location := strings.TrimPrefix(r.URL.Path, "/images/")
+		if location == "" || strings.Contains(location, "..") {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := store.Get(location)
+		if err == errBlobNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if contentType := mime.TypeByExtension(path.Ext(location)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write(data)
+	})
+	return mux
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("serve:", err)
+	}
+}
+
+// serverError logs err and answers with status 500.
+func serverError(w http.ResponseWriter, err error) {
+	log.Println("serve:", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
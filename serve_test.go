@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// TEST: NewServer answers status, card and image requests
+func TestServer(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	cards := seedProductLine(t, db, "YuGiOh", 2)
+
+	dir, err := ioutil.TempDir("", "scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, _ := store.Put("1_200w.jpg", []byte("art"))
+	WriteImageRecord(db, &ImageRecord{CardID: cards[0].ID, ProductID: cards[0].ID + 1000, Variant: "200w", Path: location, Size: 3})
+
+	server := httptest.NewServer(NewServer(db, store))
+	defer server.Close()
+
+	var status Status
+	response, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if len(status.ProductLines) != 1 || status.ProductLines[0].Cards != 2 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+
+	var card CardResponse
+	response, err = http.Get(server.URL + "/cards/" + strconv.Itoa(int(cards[0].ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(response.Body).Decode(&card)
+	response.Body.Close()
+	if card.Card.ID != cards[0].ID || card.ProductID != cards[0].ID+1000 || len(card.Images) != 1 {
+		t.Fatalf("Unexpected card response: %+v", card)
+	}
+
+	response, err = http.Get(server.URL + "/images/" + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(data) != "art" || response.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatal("Expected the stored image  Got:", string(data), response.Header.Get("Content-Type"))
+	}
+
+	for _, path := range []string{"/cards/999", "/cards/abc", "/images/missing.jpg", "/images/../tcg.db"} {
+		response, err = http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Fatal("Expected 404 for", path, " Got:", response.Status)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KnownSet records when a set of a product line was first listed by tcgplayer. It is
+// used to select the sets added since a given time, see SetFilter. Known sets are kept
+// when a product line is cleaned, so a rescrape does not make every set new.
+type KnownSet struct {
+	ProductLine string    `gorm:"primarykey;size:100"` // Lower case name of the product line
+	URLName     string    `gorm:"primarykey;size:255"`
+	Name        string    `gorm:"size:255;not null"`
+	FirstSeen   time.Time `gorm:"not null;index"`
+}
+
+// RecordKnownSets adds the sets that are not known yet to the known_sets table, with
+// seen as the time they were first seen.
+func RecordKnownSets(db *gorm.DB, productLine string, sets []itemInfo, seen time.Time) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	knownSets := make([]KnownSet, len(sets))
+	for i, set := range sets {
+		knownSets[i] = KnownSet{ProductLine: strings.ToLower(productLine), URLName: set.URLValue, Name: set.Value, FirstSeen: seen}
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(knownSets, InsertBatchSize).Error
+}
+
+// FirstSeenSets returns the time every known set of a product line was first seen,
+// keyed by set url name. Sets stored before known sets were kept are recorded by the
+// migration that added them, so stored sets need not be consulted here.
+func FirstSeenSets(db *gorm.DB, productLine string) (map[string]time.Time, error) {
+	var knownSets []KnownSet
+	tx := db.Where("product_line = ?", strings.ToLower(productLine)).Find(&knownSets)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	firstSeen := make(map[string]time.Time, len(knownSets))
+	for _, elem := range knownSets {
+		firstSeen[elem.URLName] = elem.FirstSeen
+	}
+	return firstSeen, nil
+}
+
+// SetPattern matches set names and url names, ignoring case. Patterns are globs, see
+// path.Match, or regular expressions if they start with "re:".
+type SetPattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// ParseSetPattern parses a glob or "re:" prefixed regular expression.
+func ParseSetPattern(pattern string) (SetPattern, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return SetPattern{}, fmt.Errorf("invalid set pattern %q: %v", pattern, err)
+		}
+		return SetPattern{regexp: re}, nil
+	}
+	glob := strings.ToLower(pattern)
+	if _, err := path.Match(glob, ""); err != nil {
+		return SetPattern{}, fmt.Errorf("invalid set pattern %q: %v", pattern, err)
+	}
+	return SetPattern{glob: glob}, nil
+}
+
+// Match reports whether the name or url name of set matches the pattern.
+func (p SetPattern) Match(set itemInfo) bool {
+	for _, name := range []string{set.Value, set.URLValue} {
+		if p.regexp != nil {
+			if p.regexp.MatchString(name) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p.glob, strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFilter selects the sets of a product line to scrape. The zero SetFilter selects
+// every set.
+type SetFilter struct {
+	Names      string       // Comma separated set names or url names, see selectSets
+	Include    []SetPattern // A set must match one of these, unless there are none
+	Exclude    []SetPattern // A set must match none of these
+	MinCards   int
+	MaxCards   int       // Zero for no maximum
+	AddedSince time.Time // Only sets first seen at or after this time, see KnownSet
+}
+
+// IsZero reports whether the filter selects every set.
+func (f *SetFilter) IsZero() bool {
+	return strings.TrimSpace(f.Names) == "" && len(f.Include) == 0 && len(f.Exclude) == 0 &&
+		f.MinCards == 0 && f.MaxCards == 0 && f.AddedSince.IsZero()
+}
+
+// Select returns the sets that pass the filter. firstSeen maps set url names to the
+// time they were first seen, see FirstSeenSets; sets missing from it are new and count
+// as seen now.
+func (f *SetFilter) Select(sets []itemInfo, firstSeen map[string]time.Time) []itemInfo {
+	var selected []itemInfo
+	for _, set := range selectSets(sets, f.Names) {
+		if len(f.Include) > 0 && !matchAny(f.Include, set) {
+			continue
+		}
+		if matchAny(f.Exclude, set) {
+			continue
+		}
+		if int(set.Count) < f.MinCards || (f.MaxCards > 0 && int(set.Count) > f.MaxCards) {
+			continue
+		}
+		if seen, ok := firstSeen[set.URLValue]; ok && seen.Before(f.AddedSince) {
+			continue
+		}
+		selected = append(selected, set)
+	}
+	return selected
+}
+
+// matchAny reports whether one of patterns matches set.
+func matchAny(patterns []SetPattern, set itemInfo) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(set) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSince parses the time of the "added since" filter, a date like 2021-07-01 or an
+// RFC 3339 time.
+func ParseSince(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or an RFC 3339 time", value)
+	}
+	return t, nil
+}
+
+// setPatternFlag is a flag.Value that adds a SetPattern to a list every time it is set.
+type setPatternFlag []SetPattern
+
+func (l *setPatternFlag) String() string {
+	return ""
+}
+
+func (l *setPatternFlag) Set(value string) error {
+	pattern, err := ParseSetPattern(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, pattern)
+	return nil
+}
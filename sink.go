@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// The error policies of a sink, see SinkOptions.
+const (
+	SinkFail    = "fail"    // Stop the scrape
+	SinkSkip    = "skip"    // Log the error and drop the batch
+	SinkDisable = "disable" // Log the error and stop writing to the sink
+)
+
+// SinkErrorPolicies lists the valid error policies of a sink.
+var SinkErrorPolicies = []string{SinkFail, SinkSkip, SinkDisable}
+
+// Sink is a destination of the card listings of a scrape. Write receives a batch of
+// listings of one set, as returned by one tcgplayer request. It is called from the
+// goroutines of a FanOut and must be safe for concurrent use if the sink has more than
+// one worker.
+type Sink interface {
+	Name() string
+	Write(batch []CardAttrs) error
+}
+
+// SinkOptions controls how a FanOut writes to a sink.
+type SinkOptions struct {
+	Workers      int    // Goroutines writing to the sink, one if zero
+	Buffer       int    // Batches queued for the sink before FanOut.Write waits, one if zero
+	OnError      string // One of SinkErrorPolicies, SinkFail if empty
+	DropWhenFull bool   // Drop batches instead of waiting for a full queue
+}
+
+// SinkStats counts the batches handed to a sink by a FanOut.
+type SinkStats struct {
+	Name     string
+	Batches  int64 // Written batches
+	Cards    int64 // Listings of the written batches
+	Failed   int64
+	Dropped  int64 // Batches dropped because the queue was full or the sink stopped
+	Disabled bool
+	Err      error // The last error
+}
+
+// FanOut is a Sink that writes every batch to several sinks. Every sink has its own
+// queue and workers, so a slow sink only holds up the scrape once its queue is full,
+// and its own error policy, see SinkOptions. FanOut.Write is safe for concurrent use.
+type FanOut struct {
+	outputs []*sinkOutput
+}
+
+// sinkOutput is a sink of a FanOut with its queue.
+type sinkOutput struct {
+	sink    Sink
+	options SinkOptions
+	batches chan []CardAttrs
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	stats   SinkStats
+	err     error // The error that stopped the scrape, for SinkFail
+}
+
+// NewFanOut returns a FanOut without sinks.
+func NewFanOut() *FanOut {
+	return &FanOut{}
+}
+
+// Add adds a sink and starts its workers. Sinks must be added before the first Write.
+func (f *FanOut) Add(sink Sink, options SinkOptions) {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.Buffer < 1 {
+		options.Buffer = 1
+	}
+	if options.OnError == "" {
+		options.OnError = SinkFail
+	}
+	output := &sinkOutput{
+		sink:    sink,
+		options: options,
+		batches: make(chan []CardAttrs, options.Buffer),
+		stats:   SinkStats{Name: sink.Name()},
+	}
+	output.wg.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go output.run()
+	}
+	f.outputs = append(f.outputs, output)
+}
+
+// Name returns the names of the sinks.
+func (f *FanOut) Name() string {
+	names := make([]string, len(f.outputs))
+	for i, output := range f.outputs {
+		names[i] = output.sink.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Write queues batch for every sink. It returns the error of a sink with the SinkFail
+// policy once the sink has failed.
+func (f *FanOut) Write(batch []CardAttrs) error {
+	for _, output := range f.outputs {
+		err := output.queue(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close waits until the queued batches are written and returns the error of a sink
+// with the SinkFail policy, if one failed. The FanOut cannot be written to afterwards.
+func (f *FanOut) Close() error {
+	for _, output := range f.outputs {
+		close(output.batches)
+	}
+	var err error
+	for _, output := range f.outputs {
+		output.wg.Wait()
+		if outputErr := output.failure(); outputErr != nil && err == nil {
+			err = outputErr
+		}
+	}
+	return err
+}
+
+// Stats returns the counts of every sink, in the order they were added.
+func (f *FanOut) Stats() []SinkStats {
+	stats := make([]SinkStats, len(f.outputs))
+	for i, output := range f.outputs {
+		output.mu.Lock()
+		stats[i] = output.stats
+		output.mu.Unlock()
+	}
+	return stats
+}
+
+// Report writes the counts of every sink to w.
+func (f *FanOut) Report(w io.Writer) {
+	format := "%-40s %9v %9v %9v %9v  %s\n"
+	fmt.Fprintf(w, format, "SINK", "BATCHES", "CARDS", "FAILED", "DROPPED", "STATUS")
+	for _, stats := range f.Stats() {
+		status := "ok"
+		if stats.Disabled {
+			status = "disabled"
+		}
+		if stats.Err != nil {
+			status += ": " + stats.Err.Error()
+		}
+		fmt.Fprintf(w, format, stats.Name, stats.Batches, stats.Cards, stats.Failed, stats.Dropped, status)
+	}
+}
+
+// queue adds batch to the queue of the sink, waiting for room unless the sink drops
+// batches when its queue is full.
+func (output *sinkOutput) queue(batch []CardAttrs) error {
+	if err := output.failure(); err != nil {
+		return err
+	}
+	output.mu.Lock()
+	disabled := output.stats.Disabled
+	if disabled {
+		output.stats.Dropped++
+	}
+	output.mu.Unlock()
+	if disabled {
+		return nil
+	}
+	if !output.options.DropWhenFull {
+		output.batches <- batch
+		return nil
+	}
+	select {
+	case output.batches <- batch:
+	default:
+		output.mu.Lock()
+		output.stats.Dropped++
+		output.mu.Unlock()
+	}
+	return nil
+}
+
+// failure returns the error that stopped the scrape, if the sink failed.
+func (output *sinkOutput) failure() error {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	return output.err
+}
+
+// run writes the queued batches to the sink until the queue is closed. Batches queued
+// after the sink failed or was disabled are discarded, so Write never blocks on a sink
+// that stopped.
+func (output *sinkOutput) run() {
+	defer output.wg.Done()
+
+	for batch := range output.batches {
+		output.mu.Lock()
+		stopped := output.err != nil || output.stats.Disabled
+		if stopped {
+			output.stats.Dropped++
+		}
+		output.mu.Unlock()
+		if stopped {
+			continue
+		}
+		err := output.sink.Write(batch)
+
+		output.mu.Lock()
+		if err == nil {
+			output.stats.Batches++
+			output.stats.Cards += int64(len(batch))
+			output.mu.Unlock()
+			continue
+		}
+		output.stats.Failed++
+		output.stats.Err = err
+		switch output.options.OnError {
+		case SinkSkip:
+			log.Println("sink", output.stats.Name+":", err)
+		case SinkDisable:
+			output.stats.Disabled = true
+			log.Println("sink", output.stats.Name+":", err, "(disabled)")
+		default:
+			output.err = fmt.Errorf("sink %s: %v", output.stats.Name, err)
+		}
+		output.mu.Unlock()
+	}
+}
+
+// SinkCardAttrs is meant to be executed as a goroutine. It reads card listings from
+// dataChan and writes them to fanOut, until it reads nil. Once a sink of fanOut has
+// failed, the remaining listings are discarded and FanOut.Close returns the error.
+func SinkCardAttrs(wg *sync.WaitGroup, dataChan chan []CardAttrs, fanOut *FanOut) {
+	defer wg.Done()
+
+	failed := false
+	for true {
+		data := <-dataChan
+		if data == nil {
+			break
+		}
+		if failed {
+			continue // Drain dataChan so the requests can finish
+		}
+		if fanOut.Write(data) != nil {
+			failed = true
+			continue
+		}
+		fmt.Printf("%-60s  %d queued\n", data[0].SetName, len(data))
+	}
+}
+
+// DatabaseSink writes card listings to the cards and product_mappings tables. It is
+// safe for concurrent use.
+type DatabaseSink struct {
+	db     *gorm.DB
+	setMap map[string]tcm.SetInfo // See MakeSetMap
+}
+
+// NewDatabaseSink returns a DatabaseSink writing the cards of the sets in setMap to db.
+func NewDatabaseSink(db *gorm.DB, setMap map[string]tcm.SetInfo) *DatabaseSink {
+	return &DatabaseSink{db: db, setMap: setMap}
+}
+
+// Name returns "database".
+func (s *DatabaseSink) Name() string {
+	return "database"
+}
+
+// Write writes the cards of batch and their product mappings.
+func (s *DatabaseSink) Write(batch []CardAttrs) error {
+	cardInfoList, err := makeCardInfoList(batch, s.setMap)
+	if err != nil {
+		return err
+	}
+	err = writeCardInfo(s.db, batch, cardInfoList)
+	if err != nil {
+		return err
+	}
+	mappingList, _ := makeProductMappingList(batch, cardInfoList)
+	return writeProductMappings(s.db, mappingList).Error
+}
+
+// Name returns "jsonl:" followed by the directory of the archive.
+func (a *JSONLArchive) Name() string {
+	return "jsonl:" + a.Dir
+}
+
+// Write appends batch to the file of its set, see WriteCards.
+func (a *JSONLArchive) Write(batch []CardAttrs) error {
+	return a.WriteCards(batch)
+}
+
+// WebhookBatch is the body of the requests of a WebhookSink.
+type WebhookBatch struct {
+	ProductLine string      `json:"product_line"`
+	Set         string      `json:"set"`
+	Cards       []CardAttrs `json:"cards"`
+}
+
+// WebhookSink posts every batch of card listings as a JSON WebhookBatch to a URL, e.g.
+// of a message queue gateway. It is safe for concurrent use.
+type WebhookSink struct {
+	URL     string
+	Retries int // Retries of a failed request, see postNotification
+	client  *http.Client
+}
+
+// NewWebhookSink returns a WebhookSink posting to rawURL, which must be an http or
+// https URL.
+func NewWebhookSink(rawURL string) (*WebhookSink, error) {
+	err := validateWebhookURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: time.Duration(DefaultTimeout) * time.Second}
+	return &WebhookSink{URL: rawURL, client: client}, nil
+}
+
+// Name returns "webhook:" followed by the host of the URL.
+func (s *WebhookSink) Name() string {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "webhook"
+	}
+	return "webhook:" + u.Host
+}
+
+// Write posts batch. Network errors, 429 and 5xx responses are retried like
+// notifications, see postNotification; other responses than 2xx are errors.
+func (s *WebhookSink) Write(batch []CardAttrs) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(WebhookBatch{ProductLine: batch[0].ProductLineURLName, Set: batch[0].SetURLName, Cards: batch})
+	if err != nil {
+		return err
+	}
+	return postNotification(s.client, WebhookTarget{URL: s.URL}, body, s.Retries)
+}
+
+// validateWebhookURL returns an error unless rawURL is an absolute http or https URL.
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q, expected an http or https URL", rawURL)
+	}
+	return nil
+}
+
+// addConfiguredSinks adds the sinks configured in cfg to f. The database sink is not
+// configured there, it depends on the product line, see NewDatabaseSink.
+func addConfiguredSinks(f *FanOut, cfg SinkConfig) error {
+	if cfg.Archive.Target != "" {
+		archive, err := NewJSONLArchive(cfg.Archive.Target)
+		if err != nil {
+			return err
+		}
+		f.Add(archive, cfg.Archive.Options())
+	}
+	if cfg.Webhook.Target != "" {
+		webhook, err := NewWebhookSink(cfg.Webhook.Target)
+		if err != nil {
+			return err
+		}
+		webhook.Retries = cfg.Webhook.Retries
+		f.Add(webhook, cfg.Webhook.Options())
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+)
+
+// testSink records the batches written to it and fails the batches of set fail.
+type testSink struct {
+	name    string
+	fail    string
+	block   chan bool // Write waits for a value if not nil
+	mu      sync.Mutex
+	batches int
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Write(batch []CardAttrs) error {
+	if s.block != nil {
+		<-s.block
+	}
+	if batch[0].SetURLName == s.fail {
+		return errors.New("write failed")
+	}
+	s.mu.Lock()
+	s.batches++
+	s.mu.Unlock()
+	return nil
+}
+
+// TEST: FanOut writes every batch to every sink, with the error policy of each sink
+func TestFanOut(t *testing.T) {
+	batch := func(set string) []CardAttrs {
+		return []CardAttrs{{ProductLineURLName: "YuGiOh", SetName: set, SetURLName: set}, {SetURLName: set}}
+	}
+
+	ok := &testSink{name: "ok"}
+	skip := &testSink{name: "skip", fail: "bad"}
+	disable := &testSink{name: "disable", fail: "bad"}
+	fanOut := NewFanOut()
+	fanOut.Add(ok, SinkOptions{Workers: 2, Buffer: 4})
+	fanOut.Add(skip, SinkOptions{OnError: SinkSkip})
+	fanOut.Add(disable, SinkOptions{OnError: SinkDisable})
+	for _, set := range []string{"good", "bad", "good", "good"} {
+		if err := fanOut.Write(batch(set)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fanOut.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats := fanOut.Stats()
+	if ok.batches != 4 || stats[0].Cards != 8 {
+		t.Fatal("Expected 4 batches of 2 cards to be written to the sink without errors  Got:", stats[0])
+	}
+	if skip.batches != 3 || stats[1].Failed != 1 || stats[1].Disabled {
+		t.Fatal("Expected a skipping sink to drop the failed batch only  Got:", stats[1])
+	}
+	if disable.batches != 1 || !stats[2].Disabled || stats[2].Batches+stats[2].Failed+stats[2].Dropped != 4 {
+		t.Fatal("Expected a disabled sink to drop the batches after its error  Got:", stats[2])
+	}
+
+	// TEST: SinkCardAttrs keeps reading after a sink failed and Close returns the error
+	fail := &testSink{name: "fail", fail: "bad"}
+	fanOut = NewFanOut()
+	fanOut.Add(fail, SinkOptions{})
+	var wg sync.WaitGroup
+	dataChan := make(chan []CardAttrs, 1)
+	wg.Add(1)
+	go SinkCardAttrs(&wg, dataChan, fanOut)
+	for _, set := range []string{"bad", "good", "good", "good"} {
+		dataChan <- batch(set)
+	}
+	dataChan <- nil
+	wg.Wait()
+	if err := fanOut.Close(); err == nil {
+		t.Fatal("Expected the error of a failing sink")
+	}
+	if fail.batches != 0 {
+		t.Fatal("Expected the batches after the failure to be discarded  Got:", fail.batches)
+	}
+
+	// TEST: A sink that drops batches does not hold up the others when it is slow
+	slow := &testSink{name: "slow", block: make(chan bool)}
+	fanOut = NewFanOut()
+	fanOut.Add(slow, SinkOptions{Buffer: 1, DropWhenFull: true})
+	for i := 0; i < 5; i++ {
+		fanOut.Write(batch("good"))
+	}
+	close(slow.block)
+	fanOut.Close()
+	stats = fanOut.Stats()
+	if stats[0].Dropped < 3 || stats[0].Batches+stats[0].Dropped != 5 {
+		t.Fatal("Expected the batches that did not fit the queue to be dropped  Got:", stats[0])
+	}
+}
+
+// TEST: WebhookSink posts every batch as JSON
+func TestWebhookSink(t *testing.T) {
+	defer func(backoff time.Duration) { WebhookBackoff = backoff }(WebhookBackoff)
+	WebhookBackoff = time.Millisecond
+
+	var received []WebhookBatch
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body WebhookBatch
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		attempts++
+		if body.Set == "broken" || (body.Set == "flaky" && attempts == 1) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, body)
+	}))
+	defer server.Close()
+
+	if _, err := NewWebhookSink("ftp://example.com"); err == nil {
+		t.Fatal("Expected an error for a URL that is not http or https")
+	}
+	sink, err := NewWebhookSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Retries = 2
+	if err = sink.Write([]CardAttrs{{SetURLName: "flaky"}}); err != nil || attempts != 2 {
+		t.Fatal("Expected the batch to be posted on the second attempt  Got:", attempts, err)
+	}
+	received = nil
+	err = sink.Write([]CardAttrs{{ProductLineURLName: "YuGiOh", SetURLName: "metal-raiders", ProductID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].ProductLine != "YuGiOh" || received[0].Set != "metal-raiders" || len(received[0].Cards) != 1 {
+		t.Fatal("Expected the batch to be posted  Got:", received)
+	}
+	attempts = 0
+	if sink.Write([]CardAttrs{{SetURLName: "broken"}}) == nil || attempts != 3 {
+		t.Fatal("Expected an error after the retries  Got:", attempts)
+	}
+}
+
+// TEST: DatabaseSink returns database errors instead of retrying or ignoring them
+func TestDatabaseSink(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+	cards := seedProductLine(t, db, "YuGiOh", 1)
+	setMap, err := MakeSetMap(db, "YuGiOh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewDatabaseSink(db, setMap)
+	batch := []CardAttrs{{ProductLineURLName: "YuGiOh", SetName: "YuGiOh Set", ProductName: "Dark Magician", ProductID: float32(cards[0].ID + 2000)}}
+	if err = sink.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	var card tcm.YuGiOhCardInfo
+	db.Order("id DESC").First(&card)
+	if card.Name != "Dark Magician" {
+		t.Fatal("Expected the card to be written  Got:", card)
+	}
+
+	// TEST: A rescrape updates the cards of mapped products in place
+	db.Create(&CardPrice{CardID: card.ID, ProductID: cards[0].ID + 2000, MarketPrice: 1, FetchedAt: time.Now()})
+	batch[0].ProductName = "Dark Magician (Alternate Art)"
+	if err = sink.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(&tcm.YuGiOhCardInfo{}).Count(&count)
+	var rescraped tcm.YuGiOhCardInfo
+	db.First(&rescraped, card.ID)
+	cardIDs, _ := LookupCardIDs(db, []uint{cards[0].ID + 2000})
+	if count != 2 || rescraped.Name != "Dark Magician (Alternate Art)" || cardIDs[cards[0].ID+2000] != card.ID {
+		t.Fatal("Expected the card to keep its id  Got:", count, rescraped, cardIDs)
+	}
+
+	if err = db.Migrator().DropTable(&ProductMapping{}); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Write(batch) == nil {
+		t.Fatal("Expected the error of the failed write")
+	}
+}
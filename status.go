@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// Status summarizes the state of the database.
+type Status struct {
+	SchemaVersion       uint                `json:"schema_version"`
+	LatestSchemaVersion uint                `json:"latest_schema_version"`
+	ProductLines        []ProductLineStatus `json:"product_lines"` // Empty while migrations are pending
+}
+
+// ProductLineStatus holds the number of rows stored for a product line.
+type ProductLineStatus struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Sets     int64  `json:"sets"`
+	Cards    int64  `json:"cards"`
+	Products int64  `json:"products"` // Cards with a product mapping
+	Images   int64  `json:"images"`   // Image manifest records, including derivatives
+	Prices   int64  `json:"prices"`   // Price observations
+}
+
+// GetStatus returns the schema version of db and the row counts of every product line.
+func GetStatus(db *gorm.DB) (*Status, error) {
+	version, err := SchemaVersionOf(db)
+	if err != nil {
+		return nil, err
+	}
+	status := Status{SchemaVersion: version, LatestSchemaVersion: LatestSchemaVersion()}
+	if version != status.LatestSchemaVersion {
+		return &status, nil
+	}
+
+	var productLines []tcm.ProductLine
+	tx := db.Order("name").Find(&productLines)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, productLine := range productLines {
+		elem := ProductLineStatus{ID: productLine.ID, Name: productLine.Name}
+		cardIDs := db.Model(&ProductMapping{}).Select("card_id").Where("product_line_id = ?", productLine.ID)
+		counts := []struct {
+			query *gorm.DB
+			count *int64
+		}{
+			{db.Model(&tcm.SetInfo{}).Where("product_line_id = ?", productLine.ID), &elem.Sets},
+			{db.Model(&tcm.YuGiOhCardInfo{}).Where("product_line_id = ?", productLine.ID), &elem.Cards},
+			{db.Model(&ProductMapping{}).Where("product_line_id = ?", productLine.ID), &elem.Products},
+			{imageRecordsOf(db, productLine.ID), &elem.Images},
+			{db.Model(&CardPrice{}).Where("card_id IN (?)", cardIDs), &elem.Prices},
+		}
+		for _, c := range counts {
+			tx = c.query.Count(c.count)
+			if tx.Error != nil {
+				return nil, tx.Error
+			}
+		}
+		status.ProductLines = append(status.ProductLines, elem)
+	}
+	return &status, nil
+}
+
+// PrintStatus writes status as a table to w.
+func PrintStatus(w io.Writer, status *Status) {
+	fmt.Fprintf(w, "Schema version: %d of %d\n", status.SchemaVersion, status.LatestSchemaVersion)
+	if status.SchemaVersion != status.LatestSchemaVersion {
+		fmt.Fprintln(w, "Migrations are pending, run \"scraper migrate up\".")
+		return
+	}
+	fmt.Fprintf(w, "%-30s %8s %8s %8s %8s %8s\n", "PRODUCT LINE", "SETS", "CARDS", "PRODUCTS", "IMAGES", "PRICES")
+	for _, elem := range status.ProductLines {
+		fmt.Fprintf(w, "%-30s %8d %8d %8d %8d %8d\n", elem.Name, elem.Sets, elem.Cards, elem.Products, elem.Images, elem.Prices)
+	}
+}
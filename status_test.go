@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	tcm "github.com/gurbos/tcmodels"
+	"gorm.io/gorm"
+)
+
+// seedProductLine writes a product line with one set of cardCount mapped cards and
+// returns the cards. Product ids are the card ids plus 1000.
+func seedProductLine(t *testing.T, db *gorm.DB, name string, cardCount int) []tcm.YuGiOhCardInfo {
+	productLine := tcm.ProductLine{Name: name, URLName: name}
+	if tx := db.Create(&productLine); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	set := tcm.SetInfo{Name: name + " Set", URLName: name + "-set", ProductLineID: productLine.ID}
+	db.Create(&set)
+	cards := make([]tcm.YuGiOhCardInfo, cardCount)
+	for i := range cards {
+		cards[i] = tcm.YuGiOhCardInfo{Name: name + " Card " + strconv.Itoa(i), Number: strconv.Itoa(i), SetID: set.ID, ProductLineID: productLine.ID}
+	}
+	if tx := db.Create(&cards); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	mappings := make([]ProductMapping, cardCount)
+	for i, card := range cards {
+		mappings[i] = ProductMapping{ProductID: card.ID + 1000, CardID: card.ID, ProductLineID: productLine.ID, SetID: set.ID}
+	}
+	if tx := writeProductMappings(db, mappings); tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	return cards
+}
+
+// TEST: GetStatus counts the rows of every product line
+func TestStatus(t *testing.T) {
+	db, done := testDB(t)
+	defer done()
+
+	seedProductLine(t, db, "YuGiOh", 3)
+	magic := seedProductLine(t, db, "Magic", 2)
+	db.Create(&CardPrice{CardID: magic[0].ID, ProductID: magic[0].ID + 1000, MarketPrice: 1.5, FetchedAt: time.Now()})
+
+	status, err := GetStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SchemaVersion != LatestSchemaVersion() || len(status.ProductLines) != 2 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	first, second := status.ProductLines[0], status.ProductLines[1]
+	if first.Name != "Magic" || first.Cards != 2 || first.Products != 2 || first.Prices != 1 || first.Sets != 1 {
+		t.Fatalf("Unexpected product line status: %+v", first)
+	}
+	if second.Name != "YuGiOh" || second.Cards != 3 || second.Prices != 0 {
+		t.Fatalf("Unexpected product line status: %+v", second)
+	}
+}
@@ -33,7 +33,7 @@ type RequestPayload struct {
 	Filters       filter        `json:"filters"`
 	ListingSearch listingSearch `json:"listingSearch"`
 	Context       context       `json:"context"`
-	Sort          sort          `json:"sort"`
+	Sort          _sort         `json:"sort"`
 }
 
 type filter struct {
@@ -70,7 +70,7 @@ type _filter struct {
 
 type _term struct{}
 type _range struct{}
-type sort struct{}
+type _sort struct{}
 
 // ToJSON returns a json encoded string from the attributes
 // of the associated RequestData structure. An empty string is returned
@@ -232,6 +232,7 @@ func tcgpHTTPRequest(method string, url string, body string) *http.Request {
 }
 
 func MakeTcgPlayerRequest(requestBody string, timeout int) (*ResponsePayload, *TcgpError) {
+	TcgpRateLimiter.Wait()
 	request := tcgpHTTPRequest(http.MethodPost, TcgpDataURL, requestBody)
 	client := http.Client{Timeout: time.Duration(timeout) * time.Second}
 
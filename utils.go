@@ -2,167 +2,88 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 
 	tcm "github.com/gurbos/tcmodels"
-	"github.com/joho/godotenv"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
-// DataSourceName attributes hold informaition about a specific database.
-// The information is used to connect to said database.
-type DataSourceName struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	Database string
+// InsertBatchSize is the maximum number of rows written by a single INSERT statement.
+// Large sets are split into chunks of this size to stay below MySQL's max_allowed_packet
+// and placeholder limits.
+var InsertBatchSize int = 500
+
+// ProductMapping maps a tcgplayer product id to the id of the corresponding card
+// info. The mapping is kept across runs, so images and prices can be matched to
+// existing cards without scraping the card data again.
+type ProductMapping struct {
+	ProductID     uint `gorm:"primarykey;autoIncrement:false"` // Product ID assigned by tcgplayer
+	CardID        uint `gorm:"not null;uniqueIndex"`           // ID of the corresponding card info
+	ProductLineID uint `gorm:"not null;index"`
+	SetID         uint `gorm:"not null;index"`
 }
 
-func (ds *DataSourceName) Init() {
-	var present bool
-	ds.Host, present = os.LookupEnv("TCG_DB_HOST")
-	if !present {
-		log.Fatal("TCG_DB_HOST enviroment variable missing!")
-	}
-	ds.Port, present = os.LookupEnv("TCG_DB_PORT")
-	if !present {
-		log.Fatal("TCG_DB_PORT enviroment variable missing!")
-	}
-	ds.User, present = os.LookupEnv("TCG_DB_USER")
-	if !present {
-		log.Fatal("TCG_DB_USER enviroment variable missing!")
-	}
-	ds.Password, present = os.LookupEnv("TCG_DB_PASSWD")
-	if !present {
-		log.Fatal("TCG_DB_PASSWD enviroment variable missing!")
-	}
-	ds.Database, present = os.LookupEnv("TCG_DB_NAME")
-	if !present {
-		log.Fatal("TCG_DB_NAME enviroment variable missing!")
-	}
-}
-
-// DSNString returns a data source identifier string
-func (dsn *DataSourceName) DSNString() string {
-	format := "%s:%s@tcp(%s:%s)/%s" //?charset=utf8mb4&parseTime=True&loc=Local"
-	return fmt.Sprintf(format, dsn.User, dsn.Password, dsn.Host, dsn.Port, dsn.Database)
-}
-
-// CardImageID temporary model to hold tcg product id
-// which is used to identify product image.
-type CardImageID struct {
-	OldID         uint `gorm:"primarykey"` // Product ID assigned by tcgplayer
-	NewID         uint `gorm:"not null"`   // ID of the corresponding card info
-	ProductLineID uint `gorm:"not null"`
-}
-
-// Migrate creates the CardInfo database table and returns
-func Migrate(dsn string, args ...interface{}) {
-	db, err := gorm.Open(
-		mysql.Open(dsn),
-		&gorm.Config{Logger: logger.Default.LogMode(logger.Error)},
-	)
+// Migrate applies all pending schema migrations to the database identified by dsn.
+func Migrate(dsn string) {
+	db := GetDBConnection(dsn, logger.Error)
+	applied, err := MigrateUp(db, 0)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, m := range args {
-		err = db.AutoMigrate(m)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	tx := db.Exec("ALTER TABLE yu_gi_oh_card_infos MODIFY description TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;")
-	if tx.Error != nil {
-		log.Fatal(tx.Error)
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d: %s\n", m.Version, m.Name)
 	}
 }
 
-// GetDBConnection returns a database connection handle
+// GetDBConnection returns a database connection handle. The database server is
+// selected by the scheme of the dsn parameter, see ParseDSN.
 func GetDBConnection(dsn string, logLevel logger.LogLevel) *gorm.DB {
+	dialect, source, err := ParseDSN(dsn)
+	if err != nil {
+		fatal(RedactError(err, dsn))
+	}
 	db, err := gorm.Open(
-		mysql.Open(dsn),
+		dialect.Open(source),
 		&gorm.Config{Logger: logger.Default.LogMode(logLevel)},
 	)
 	if err != nil {
-		log.Fatal(err)
+		fatal(fmt.Errorf("connecting to %s: %v", RedactDSN(dsn), RedactError(err, dsn)))
 	}
 	return db
 }
 
-// DropTables drops all database tables;
+// DropTables drops the database tables owned by the scraper, see OwnedModels.
+// Other tables in the same database are left untouched.
 func DropTables(db *gorm.DB) {
-	gen, err := db.DB()
+	dialect, err := DialectOf(db)
 	if err != nil {
 		log.Fatal(err)
 	}
-	rows, err := gen.Query(
-		"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA=(?)",
-		db.Migrator().CurrentDatabase(),
-	)
+	names, err := OwnedTables(db)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer rows.Close()
-	var name string
-	tx := db.Exec("SET FOREIGN_KEY_CHECKS = 0;") // Disable checks for foreign key relationships
-	if tx.Error != nil {
-		log.Fatal(tx.Error)
-	}
-	for rows.Next() {
-		rows.Scan(&name)
-		tx := db.Exec(fmt.Sprintf("DROP TABLE %s", name))
-		if tx.Error != nil {
-			log.Fatal(tx.Error)
-		}
-	}
-	_ = db.Exec("SET FOREIGN_KEY_CHECKS = 1;") // Re-enable checks for foreign key relationships
-}
-
-func deleteTableRecords(db *gorm.DB) {
-	gen, err := db.DB()
-	if db.Migrator().HasTable(&tcm.YuGiOhCardInfo{}) {
-		_, err = gen.Exec("DELETE FROM card_infos;")
-		if err != nil {
-			log.Println(err)
-		}
-	}
-	if db.Migrator().HasTable(&tcm.SetInfo{}) {
-		_, err = gen.Exec("DELETE FROM set_infos;")
-		if err != nil {
-			log.Println(err)
-		}
-	}
-	if db.Migrator().HasTable(&tcm.ProductLine{}) {
-		_, err = gen.Exec("DELETE FROM product_lines;")
-		if err != nil {
-			log.Println(err)
-		}
+	err = dialect.DropTables(db, names...)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-// GetDataSource returns a DataSourceName object with that specifies
-// the data source used during production.
+// GetDataSource returns the data source configured by the config file named in the
+// TCG_CONFIG environment variable and by the environment, see LoadConfig.
 func GetDataSource() DataSourceName {
-	godotenv.Load("/home/gurbos/Projects/golang/scraper/.env")
-	dataSource := DataSourceName{
-		Host:     os.Getenv("DB_HOST"),
-		Port:     os.Getenv("DB_PORT"),
-		User:     os.Getenv("DB_USER"),
-		Password: os.Getenv("DB_PASSWD"),
-		Database: os.Getenv("DB_NAME"),
-	}
-	return dataSource
+	cfg, err := LoadConfig(os.Getenv("TCG_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg.Database
 }
 
 // DatabaseConnConfig Set the max number of open database and idle database connections
@@ -183,13 +104,15 @@ func TerminateCardInfoGoroutines(wg *sync.WaitGroup, dataChan chan *RequestPaylo
 	wg.Wait()
 }
 
-func TerminateCardImageGoroutines(wg *sync.WaitGroup, dataChan chan []CardImageID, numRoutines int) {
+func TerminateCardImageGoroutines(wg *sync.WaitGroup, dataChan chan []ProductMapping, numRoutines int) {
 	for i := 0; i < numRoutines; i++ {
 		dataChan <- nil
 	}
 	wg.Wait()
 }
 
+// WriteProductLineInfo writes the active product line of data. A stored product line
+// with the same url name is updated in place, so its id stays the same across runs.
 func WriteProductLineInfo(db *gorm.DB, data Result) *gorm.DB {
 	var tx *gorm.DB
 	for _, elem := range data.Aggregations.ProductLineName {
@@ -200,16 +123,57 @@ func WriteProductLineInfo(db *gorm.DB, data Result) *gorm.DB {
 				SetCount:  uint(len(data.Aggregations.SetName)),
 				CardCount: uint(data.TotalResults),
 			}
-			tx = db.Create(&productLine)
+			var stored []tcm.ProductLine
+			tx = db.Where("url_name = ?", elem.URLValue).Limit(1).Find(&stored)
+			if tx.Error != nil {
+				break
+			}
+			if len(stored) == 0 {
+				tx = db.Create(&productLine)
+				break
+			}
+			tx = db.Model(&stored[0]).Updates(map[string]interface{}{
+				"name":       productLine.Name,
+				"set_count":  productLine.SetCount,
+				"card_count": productLine.CardCount,
+			})
 			break
 		}
 	}
 	return tx
 }
 
+// GetProductLineID returns the id of the product line with the given name, see
+// whereProductLine.
+func GetProductLineID(dbConn *gorm.DB, productLine string) (uint, error) {
+	var productLineID ProductLineID
+	tx := whereProductLine(dbConn.Model(tcm.ProductLine{}), productLine).First(&productLineID)
+	return productLineID.ID, tx.Error
+}
+
+// whereProductLine selects the product lines whose name or url name is name, ignoring
+// case. Product lines are written by url name, see WriteProductLineInfo, and named by
+// users in any case.
+func whereProductLine(query *gorm.DB, name string) *gorm.DB {
+	lower := strings.ToLower(name)
+	return query.Where("(LOWER(name) = ? OR LOWER(url_name) = ?)", lower, lower)
+}
+
+// GetSetID returns the id of the set with the given name or url name. If productLineID
+// is not zero, only the sets of that product line are searched.
+func GetSetID(dbConn *gorm.DB, productLineID uint, set string) (uint, error) {
+	var setInfo tcm.SetInfo
+	query := dbConn.Model(tcm.SetInfo{}).Where("name = ? OR url_name = ?", set, set)
+	if productLineID != 0 {
+		query = query.Where("product_line_id = ?", productLineID)
+	}
+	tx := query.First(&setInfo)
+	return setInfo.ID, tx.Error
+}
+
 func MakeSetMap(dbConn *gorm.DB, productLine string) (map[string]tcm.SetInfo, error) {
 	var productLineID ProductLineID
-	tx := dbConn.Model(tcm.ProductLine{}).Where("name = ?", productLine).Find(&productLineID)
+	tx := whereProductLine(dbConn.Model(tcm.ProductLine{}), productLine).Limit(1).Find(&productLineID)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -227,17 +191,16 @@ func MakeSetMap(dbConn *gorm.DB, productLine string) (map[string]tcm.SetInfo, er
 	return setMap, nil
 }
 
-// WriteSetInfo writes the set info data passed into the data parameter and inserts
-// it into the set info database table.
+// WriteSetInfo writes the set info data passed into the data parameter to the set info
+// database table. Sets of the product line that are stored with the same url name are
+// updated in place, the others are inserted.
 func WriteSetInfo(db *gorm.DB, data aggregation) (tx *gorm.DB) {
 	var productLineID ProductLineID
-	var productLineName string
 
 	// Get ProductLineID from active ProuctLineName
 	for _, val := range data.ProductLineName {
 		if val.IsActive {
-			productLineName = val.Value
-			tx = db.Model(&tcm.ProductLine{}).Where("Name = (?)", productLineName).First(&productLineID)
+			tx = db.Model(&tcm.ProductLine{}).Where("url_name = ?", val.URLValue).First(&productLineID)
 			if tx.Error != nil {
 				return
 			}
@@ -245,8 +208,32 @@ func WriteSetInfo(db *gorm.DB, data aggregation) (tx *gorm.DB) {
 		}
 	}
 
-	setInfoList := makeSetInfoList(productLineID.ID, data.SetName)
-	tx = db.Create(setInfoList)
+	var storedSets []tcm.SetInfo
+	tx = db.Where("product_line_id = ?", productLineID.ID).Find(&storedSets)
+	if tx.Error != nil {
+		return
+	}
+	stored := make(map[string]tcm.SetInfo, len(storedSets))
+	for _, elem := range storedSets {
+		stored[elem.URLName] = elem
+	}
+	var created []tcm.SetInfo
+	for _, set := range makeSetInfoList(productLineID.ID, data.SetName) {
+		old, ok := stored[set.URLName]
+		if !ok {
+			created = append(created, set)
+			continue
+		}
+		if old.Name != set.Name || old.CardCount != set.CardCount {
+			tx = db.Model(&old).Updates(map[string]interface{}{"name": set.Name, "card_count": set.CardCount})
+			if tx.Error != nil {
+				return
+			}
+		}
+	}
+	if len(created) > 0 {
+		tx = db.CreateInBatches(created, InsertBatchSize)
+	}
 	return
 }
 
@@ -261,7 +248,7 @@ func MakeDataRequest(requestChan chan *RequestPayload, dataChan chan []CardAttrs
 		ri = <-requestChan
 		if ri != nil {
 			for true {
-				rd, tcgpErr = MakeTcgPlayerRequest(ri.ToJSON(), 50)
+				rd, tcgpErr = MakeTcgPlayerRequest(ri.ToJSON(), DefaultTimeout)
 				if tcgpErr != nil {
 					continue
 				}
@@ -277,49 +264,75 @@ func MakeDataRequest(requestChan chan *RequestPayload, dataChan chan []CardAttrs
 	}
 }
 
-// WriteCardInfo reads card info data from a channel and writes it to the corresponding database table.
+// WriteCardInfo reads card info data from a channel and writes it to the corresponding database
+// table, see DatabaseSink.
 func WriteCardInfo(wg *sync.WaitGroup, dataChan chan []CardAttrs, db *gorm.DB, setMap map[string]tcm.SetInfo) {
 	defer wg.Done()
 
-	for true {
-		data := <-dataChan
-		if data != nil {
-			cardInfoList, err := makeCardInfoList(data, setMap)
-			if err != nil {
-				log.Fatal(err)
-			}
-			for true {
-				tx := writeCardInfo(db, cardInfoList)
-				if tx.Error != nil {
-					val := reflect.ValueOf(cardInfoList)
-					fmt.Println(tx.Error, "\n", val.Index(13), "\n\n", val.Index(12))
-					if strings.Index(tx.Error.Error(), "Duplicate entry") != -1 {
-						// keys := parseDuplicateValue(tx.Error.Error())
-						// cardInfoList = removeEntry(cardInfoList, keys[0], keys[1], keys[2], keys[3])
-						continue
-					}
-				}
-				productIDList, _ := makeCardImageIDList(data, cardInfoList)
-				tx = db.Create(productIDList)
-				if tx.Error != nil {
-					log.Fatal(tx.Error)
-				}
-				break // Break if no database write error
-			}
-			fmt.Printf("%-60s  %d\n", data[0].SetName, reflect.ValueOf(cardInfoList).Len())
-			continue // Retry database write after error handling
-		}
-		break
+	fanOut := NewFanOut()
+	fanOut.Add(NewDatabaseSink(db, setMap), SinkOptions{})
+	var sinkWG sync.WaitGroup
+	sinkWG.Add(1)
+	SinkCardAttrs(&sinkWG, dataChan, fanOut)
+	err := fanOut.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-func writeCardInfo(dbconn *gorm.DB, cards interface{}) (tx *gorm.DB) {
-	switch cards.(type) {
+// writeCardInfo writes the cards in cardInfoList, see makeCardInfoList, of the products
+// listed in attrList. Cards of products that are already mapped keep their id and are
+// updated in place if they changed, so the images and prices recorded for them stay
+// attached; unchanged cards are not written, see cardChanged. The other cards are
+// inserted. The ids of the cards are set in cardInfoList.
+func writeCardInfo(dbconn *gorm.DB, attrList []CardAttrs, cardInfoList interface{}) error {
+	productIDs := make([]uint, len(attrList))
+	for i := range attrList {
+		productIDs[i] = uint(attrList[i].ProductID)
+	}
+	cardIDs, err := LookupCardIDs(dbconn, productIDs)
+	if err != nil {
+		return err
+	}
+	storedCards, err := loadCards(dbconn, reflect.TypeOf(cardInfoList), cardIDs)
+	if err != nil {
+		return err
+	}
+
+	switch cards := cardInfoList.(type) {
 	case []tcm.YuGiOhCardInfo:
-		list := reflect.ValueOf(cards).Interface().([]tcm.YuGiOhCardInfo)
-		tx = dbconn.Create(&list)
+		var changed, created []tcm.YuGiOhCardInfo
+		var createdIndex []int
+		for i := range cards {
+			if id, ok := cardIDs[productIDs[i]]; ok {
+				cards[i].ID = id
+				if card, found := storedCards[id]; found && !cardChanged(card, reflect.ValueOf(cards[i])) {
+					continue
+				}
+				changed = append(changed, cards[i])
+			} else {
+				created = append(created, cards[i])
+				createdIndex = append(createdIndex, i)
+			}
+		}
+		if len(changed) > 0 {
+			tx := dbconn.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&changed, InsertBatchSize)
+			if tx.Error != nil {
+				return tx.Error
+			}
+		}
+		if len(created) > 0 {
+			tx := dbconn.CreateInBatches(&created, InsertBatchSize)
+			if tx.Error != nil {
+				return tx.Error
+			}
+			for j, i := range createdIndex {
+				cards[i].ID = created[j].ID
+			}
+		}
+		return nil
 	}
-	return tx
+	return fmt.Errorf("unsupported product line %q", attrList[0].ProductLineURLName)
 }
 
 // makeSetInfoList returns a list of SetInfo structures. The db parameter is a
@@ -365,7 +378,7 @@ func makeCardInfoList(attr []CardAttrs, setMap map[string]tcm.SetInfo) (interfac
 			cardInfos[i].Description = strings.TrimSpace(attr[i].CustomAttributes.Description)
 			cardInfos[i].LinkArrows = strings.Join(attr[i].CustomAttributes.LinkArrows, ",")
 
-			// cardInfos[i].ID = uint(attr[i].ProductID)
+			// The tcgplayer product id is stored in the product_mappings table, see ProductMapping
 			cardInfos[i].Level = attr[i].CustomAttributes.Level
 
 			temp := strings.Join(attr[i].CustomAttributes.MonsterType, ",")
@@ -384,19 +397,45 @@ func makeCardInfoList(attr []CardAttrs, setMap map[string]tcm.SetInfo) (interfac
 	return cardInfoList, nil
 }
 
-func makeCardImageIDList(attrList []CardAttrs, cardInfoList interface{}) ([]CardImageID, error) {
+func makeProductMappingList(attrList []CardAttrs, cardInfoList interface{}) ([]ProductMapping, error) {
 	listVal := reflect.ValueOf(cardInfoList)
-	idList := make([]CardImageID, listVal.Len(), listVal.Len())
+	mappingList := make([]ProductMapping, listVal.Len(), listVal.Len())
 	switch cardInfoList.(type) {
 	case []tcm.YuGiOhCardInfo:
 		vals := reflect.ValueOf(cardInfoList).Interface().([]tcm.YuGiOhCardInfo)
 		for i := 0; i < listVal.Len(); i++ {
-			idList[i].OldID = uint(attrList[i].ProductID)
-			idList[i].NewID = vals[i].ID
-			idList[i].ProductLineID = vals[i].ProductLineID
+			mappingList[i].ProductID = uint(attrList[i].ProductID)
+			mappingList[i].CardID = vals[i].ID
+			mappingList[i].ProductLineID = vals[i].ProductLineID
+			mappingList[i].SetID = vals[i].SetID
 		}
 	}
-	return idList, nil
+	return mappingList, nil
+}
+
+// writeProductMappings inserts the mappings in the list. Products that are already
+// mapped are pointed to the card info given, which is the mapped card unless it was
+// deleted, see writeCardInfo.
+func writeProductMappings(db *gorm.DB, mappingList []ProductMapping) *gorm.DB {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "product_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"card_id", "product_line_id", "set_id"}),
+	}).CreateInBatches(mappingList, InsertBatchSize)
+}
+
+// LookupCardIDs returns the card info ids mapped to the given tcgplayer product ids.
+// Products without a mapping are missing from the returned map.
+func LookupCardIDs(db *gorm.DB, productIDs []uint) (map[uint]uint, error) {
+	var mappingList []ProductMapping
+	tx := db.Where("product_id IN ?", productIDs).Find(&mappingList)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	cardIDs := make(map[uint]uint, len(mappingList))
+	for _, elem := range mappingList {
+		cardIDs[elem.ProductID] = elem.CardID
+	}
+	return cardIDs, nil
 }
 
 func parseDuplicateValue(errstr string) []string {
@@ -421,58 +460,6 @@ func removeEntry(list []tcm.YuGiOhCardInfo, number string, name string, rarity s
 	return list
 }
 
-func GetImages(wg *sync.WaitGroup, dataChan chan []CardImageID) {
-	defer wg.Done()
-
-	var response *http.Response
-	godotenv.Load()
-	imgDir := os.Getenv("TCG_IMAGES")
-	var remoteFileName string
-	var url string
-	client := http.Client{}
-	for true {
-		data := <-dataChan
-		if data != nil {
-			for i := 0; i < len(data); i++ {
-				remoteFileName = strconv.Itoa(int(data[i].OldID)) + "_200w.jpg" // Create remote filename from cardInfo.ProductID
-				url = TcgpImageURL + "/" + remoteFileName                       // Build filename url from resource domain and remote filename
-				request, err := http.NewRequest(http.MethodGet, url, nil)       // Create http request object
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				for true {
-					response, err = client.Do(request) // Make request and receive response
-					if err != nil {
-						continue
-					}
-					break
-				}
-
-				buff, err := ioutil.ReadAll(response.Body) // Read image file from http response body
-				if err != nil {
-					fmt.Println(err)
-				}
-				response.Body.Close()
-
-				path := path.Join(imgDir, strconv.Itoa(int(data[i].NewID))+"_200w.jpg") // Card image file is named using the corresponding card id number
-				file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0755)           // Create image file
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				_, err = file.Write(buff) // Write image contents to file
-				if err != nil {
-					fmt.Println(err)
-				}
-				file.Close()
-			}
-		} else {
-			break
-		}
-	}
-}
-
 // ProductLineID used when only requesting ProductLine.ID field from corresponding database table.
 type ProductLineID struct {
 	ID uint